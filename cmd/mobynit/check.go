@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/balena-os/hostapp"
+)
+
+// EXIT_REQUIRED_DROPPED is the exit code of the check subcommand when a
+// required OS block would be dropped
+const EXIT_REQUIRED_DROPPED = 2
+
+// checkResult is the verdict of the check subcommand on each OS block
+type checkResult struct {
+	Hostapp       string          `json:"hostapp"`
+	KernelRelease string          `json:"kernel_release"`
+	KernelABIID   string          `json:"kernel_abi_id"`
+	OSVersion     string          `json:"os_version,omitempty"`
+	Platform      string          `json:"platform,omitempty"`
+	DeviceType    string          `json:"device_type,omitempty"`
+	Extensions    []*checkVerdict `json:"extensions"`
+}
+
+type checkVerdict struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+	Kept     bool   `json:"kept"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// requiredDropped returns the required OS blocks that would be dropped
+func (r *checkResult) requiredDropped() []*checkVerdict {
+	var dropped []*checkVerdict
+	for _, v := range r.Extensions {
+		if v.Required && !v.Kept {
+			dropped = append(dropped, v)
+		}
+	}
+	return dropped
+}
+
+// runCheck implements the check subcommand. Returns the result so the
+// caller can tell whether required OS blocks would be dropped.
+func runCheck(w io.Writer, args []string) (*checkResult, error) {
+	checkCmd := flag.NewFlagSet("check", flag.ExitOnError)
+	sysroot := checkCmd.String("sysroot", "/mnt/sysroot/inactive", "root of the partition holding the new hostapp")
+	data := checkCmd.String("data", DATA_DIR_NAME, "root of the data partition")
+	deviceType := checkCmd.String("device-type", "", "device type slug (default: from the boot partition)")
+	keysDir := checkCmd.String("keys", SIGNING_KEYS_DIR, "directory of extension signing keys, besides the hostapp's")
+	asJSON := checkCmd.Bool("json", false, "print JSON")
+	checkCmd.Parse(args)
+
+	policy := hostapp.ContentPolicy{}
+	if content, err := os.ReadFile("/proc/cmdline"); err == nil {
+		policy = parseCmdline(string(content)).contentPolicy
+	}
+	r, err := check(*sysroot, *data, runningDeviceType(BOOT_MOUNT_PATH, *deviceType), *keysDir, policy)
+	if err != nil {
+		return nil, err
+	}
+	if *asJSON {
+		content, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		_, err = fmt.Fprintln(w, string(content))
+		return r, err
+	}
+	printCheck(w, r)
+	return r, nil
+}
+
+// check evaluates the OS blocks of the data partition at data against the
+// kernel, OS version and platform of the hostapp staged in sysroot, the next
+// (trial) hostapp if there is one and the current one otherwise, against
+// deviceType, against the signing keys in keysDir and the hostapp, and
+// against the content policy. Nothing is mounted.
+func check(sysroot, data, deviceType, keysDir string, policy hostapp.ContentPolicy) (*checkResult, error) {
+	candidates := hostappCandidates(sysroot, true)
+	if len(candidates) == 0 || (candidates[0].Source != NEXT_LINK && candidates[0].Source != CURRENT_LINK) {
+		return nil, fmt.Errorf("No staged hostapp found in %s", sysroot)
+	}
+	root, err := hostapp.FindID(filepath.Join(sysroot, HOSTAPP_LAYER_ROOT), candidates[0].ID)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading hostapp %s: %v", candidates[0].ID, err)
+	}
+	r := &checkResult{Hostapp: root.ID}
+	if r.KernelRelease, err = root.KernelRelease(); err != nil {
+		return nil, fmt.Errorf("Error getting hostapp kernel release: %v", err)
+	}
+	if r.KernelABIID, err = root.ResolveExtensionABIID(r.KernelRelease); err != nil {
+		return nil, fmt.Errorf("Error getting hostapp kernel ABI ID: %v", err)
+	}
+	r.OSVersion, _ = root.OSVersion()
+	r.Platform, r.DeviceType = root.Platform.String(), deviceType
+
+	// OS blocks whose layers fail to resolve are dropped while being found
+	verdicts := make(map[string]*checkVerdict)
+	verdict := func(c *hostapp.Container) *checkVerdict {
+		v, ok := verdicts[c.ID]
+		if !ok {
+			v = &checkVerdict{ID: c.ID, Name: c.Name, Required: c.IsRequired()}
+			verdicts[c.ID] = v
+			r.Extensions = append(r.Extensions, v)
+		}
+		return v
+	}
+	hostapp.Dropped = func(c hostapp.Container, reason string) {
+		verdict(&c).Reason = reason
+	}
+	defer func() { hostapp.Dropped = nil }()
+	containers, err := findExtensions(data)
+	if err != nil {
+		return nil, err
+	}
+	for i := range containers {
+		verdict(&containers[i])
+	}
+
+	keys, err := signingKeys(root, keysDir)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading signing keys: %v", err)
+	}
+	containers = hostapp.SelectSigned(containers, keys)
+	containers = hostapp.SelectPermitted(containers, &root, policy)
+	containers = hostapp.SelectOSCompatible(containers, &root)
+	host := hostapp.Host{Platform: root.Platform, DeviceType: deviceType}
+	for _, c := range hostapp.SelectMountable(containers, r.KernelRelease, r.KernelABIID, host) {
+		verdicts[c.ID].Kept = true
+	}
+	return r, nil
+}
+
+// printCheck prints a verdict per OS block
+func printCheck(w io.Writer, r *checkResult) {
+	fmt.Fprintf(w, "Hostapp %s: kernel %s, ABI ID %s, OS version %s\n", r.Hostapp, r.KernelRelease, orUnknown(r.KernelABIID), orUnknown(r.OSVersion))
+	if r.Platform != "" || r.DeviceType != "" {
+		fmt.Fprintf(w, "Platform %s, device type %s\n", orUnknown(r.Platform), orUnknown(r.DeviceType))
+	}
+	for _, v := range r.Extensions {
+		verdict := "keep"
+		if !v.Kept {
+			verdict = "drop: " + v.Reason
+		}
+		required := ""
+		if v.Required {
+			required = " [required]"
+		}
+		fmt.Fprintf(w, "  %s (%s)%s: %s\n", v.Name, v.ID, required, verdict)
+	}
+}
+
+// orUnknown is s, or "unknown" if it is empty
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
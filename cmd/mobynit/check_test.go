@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/balena-os/hostapp"
+)
+
+// writeHostappKernel adds the modules of a kernel to the fixture's hostapp
+func writeHostappKernel(t *testing.T, sysroot, release, symvers string) {
+	t.Helper()
+	modules := filepath.Join(sysroot, HOSTAPP_LAYER_ROOT, "overlay2", "hostapp-layer", "diff", "lib", "modules", release)
+	if err := os.MkdirAll(modules, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(modules, "Module.symvers"), []byte(symvers), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	options := writePlanFixture(t)
+	writeHostappKernel(t, options.sysroot, "6.1.0-test", "symbols")
+	cfgPath := filepath.Join(options.data, DATA_LAYER_ROOT, "containers", "oldkernel", "config.v2.json")
+	cfg, _ := json.Marshal(map[string]interface{}{
+		"ID": "oldkernel", "Name": "oldkernel", "Driver": "overlay2",
+		"Config": map[string]interface{}{"Labels": map[string]string{
+			HOSTOS_BLOCKS_CLASS:                  "overlay",
+			hostapp.HOSTOS_BLOCKS_KERNEL_VERSION: "5.0.0",
+			hostapp.HOSTOS_BLOCKS_REQUIRED:       "true",
+		}},
+	})
+	if err := os.WriteFile(cfgPath, cfg, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := check(options.sysroot, options.data, "", "", hostapp.ContentPolicy{})
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if r.Hostapp != "hostapp" || r.KernelRelease != "6.1.0-test" || r.KernelABIID == "" {
+		t.Errorf("unexpected hostapp kernel %+v", r)
+	}
+	got := map[string]*checkVerdict{}
+	for _, v := range r.Extensions {
+		got[v.ID] = v
+	}
+	for _, id := range []string{"early", "late", "modules"} {
+		if v := got[id]; v == nil || !v.Kept {
+			t.Errorf("expected %s to be kept, got %+v", id, v)
+		}
+	}
+	if v := got["oldkernel"]; v == nil || v.Kept || !strings.Contains(v.Reason, "kernel version") {
+		t.Errorf("expected oldkernel to be dropped for its kernel version, got %+v", v)
+	}
+	if dropped := r.requiredDropped(); len(dropped) != 1 || dropped[0].ID != "oldkernel" {
+		t.Errorf("expected oldkernel to be a required block dropped, got %+v", dropped)
+	}
+
+	var out bytes.Buffer
+	printCheck(&out, r)
+	for _, line := range []string{"Hostapp hostapp: kernel 6.1.0-test", "late (late): keep", "oldkernel (oldkernel) [required]: drop: kernel version"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in check output:\n%s", line, out.String())
+		}
+	}
+
+	// A required block whose layers do not resolve is dropped as well
+	lower := filepath.Join(options.data, DATA_LAYER_ROOT, "overlay2", "late-layer", "lower")
+	if err := os.WriteFile(lower, []byte("l/MISSING"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeLayeredContainer(t, filepath.Join(options.data, DATA_LAYER_ROOT), "late",
+		map[string]string{HOSTOS_BLOCKS_CLASS: "overlay", hostapp.HOSTOS_BLOCKS_REQUIRED: "true"}, nil)
+	if r, err = check(options.sysroot, options.data, "", "", hostapp.ContentPolicy{}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	got = map[string]*checkVerdict{}
+	for _, v := range r.Extensions {
+		got[v.ID] = v
+	}
+	if v := got["late"]; v == nil || v.Kept || !v.Required || v.Reason == "" {
+		t.Errorf("expected late to be dropped for its missing layer, got %+v", v)
+	}
+	if dropped := r.requiredDropped(); len(dropped) != 2 {
+		t.Errorf("expected late and oldkernel to be required blocks dropped, got %+v", dropped)
+	}
+	if err := os.Remove(lower); err != nil {
+		t.Fatal(err)
+	}
+
+	// Modules built for another kernel ABI are dropped too
+	writeHostappKernel(t, options.sysroot, "6.1.0-test", "other symbols")
+	if r, err = check(options.sysroot, options.data, "", "", hostapp.ContentPolicy{}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	for _, v := range r.Extensions {
+		if v.ID == "modules" && (v.Kept || !strings.Contains(v.Reason, "kernel ABI ID")) {
+			t.Errorf("expected modules to be dropped for its kernel ABI, got %+v", v)
+		}
+	}
+}
+
+func TestCheckSignatures(t *testing.T) {
+	options := writePlanFixture(t)
+	writeHostappKernel(t, options.sysroot, "6.1.0-test", "symbols")
+	pub, _, _ := ed25519.GenerateKey(nil)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(keysDir, "release.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a key loaded the unsigned OS blocks of the fixture are dropped
+	r, err := check(options.sysroot, options.data, "", keysDir, hostapp.ContentPolicy{})
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(r.Extensions) == 0 {
+		t.Fatal("expected OS blocks to be checked")
+	}
+	for _, v := range r.Extensions {
+		if v.Kept || v.Reason != "not signed" {
+			t.Errorf("expected %s to be dropped as unsigned, got %+v", v.ID, v)
+		}
+	}
+}
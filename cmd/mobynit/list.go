@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/balena-os/hostapp"
+)
+
+// listEntry is a container as printed by the list subcommand
+type listEntry struct {
+	Root              string            `json:"root"`
+	Type              string            `json:"type"`
+	ID                string            `json:"id"`
+	Name              string            `json:"name"`
+	Image             string            `json:"image"`
+	Driver            string            `json:"driver"`
+	Dead              bool              `json:"dead"`
+	RemovalInProgress bool              `json:"removal_in_progress"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	MountID           string            `json:"mount_id,omitempty"`
+	Layers            int               `json:"layers"`
+	Error             string            `json:"error,omitempty"`
+}
+
+// runList implements the list subcommand
+func runList(w io.Writer, args []string) error {
+	listCmd := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := listCmd.Bool("json", false, "print JSON instead of a table")
+	listCmd.Usage = func() {
+		fmt.Fprintln(listCmd.Output(), "Usage: mobynit list [-json] <path>")
+		fmt.Fprintln(listCmd.Output(), "path is a storage root, or a sysroot or data partition holding them")
+		listCmd.PrintDefaults()
+	}
+	listCmd.Parse(args)
+	if listCmd.NArg() != 1 {
+		listCmd.Usage()
+		return fmt.Errorf("Expected one path")
+	}
+
+	entries, err := listStorage(listCmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		content, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(content))
+		return err
+	}
+	printList(w, entries)
+	return nil
+}
+
+// storageRoots returns path if it is a storage root itself, or else the
+// storage roots a sysroot or data partition mounted at path holds
+func storageRoots(path string) []string {
+	isRoot := func(dir string) bool {
+		for _, marker := range []string{"containers", "overlay-containers", filepath.Join("image", "overlay2")} {
+			if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+	if isRoot(path) {
+		return []string{path}
+	}
+	var roots []string
+	for _, sub := range []string{HOSTAPP_LAYER_ROOT, DATA_LAYER_ROOT, DATA_STORAGE_LAYER_ROOT} {
+		if dir := filepath.Join(path, sub); isRoot(dir) {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
+}
+
+// listStorage reads the containers and images of the storage roots at path
+func listStorage(path string) ([]listEntry, error) {
+	roots := storageRoots(path)
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("No storage root found in %s", path)
+	}
+	var entries []listEntry
+	for _, root := range roots {
+		containers, err := hostapp.ListAll(root)
+		if err != nil {
+			return nil, fmt.Errorf("Error listing %s: %v", root, err)
+		}
+		sort.SliceStable(containers, func(i, j int) bool {
+			return !containers[i].IsImage() && containers[j].IsImage()
+		})
+		for _, c := range containers {
+			entry := listEntry{
+				Root:              root,
+				Type:              "container",
+				ID:                c.ID,
+				Name:              c.Name,
+				Image:             c.Image,
+				Driver:            c.Driver,
+				Dead:              c.State.Dead,
+				RemovalInProgress: c.State.RemovalInProgress,
+			}
+			if c.IsImage() {
+				entry.Type = "image"
+			}
+			for key, val := range c.Labels {
+				if strings.HasPrefix(key, hostapp.HOSTOS_BLOCKS_LABEL_PREFIX) {
+					if entry.Labels == nil {
+						entry.Labels = make(map[string]string)
+					}
+					entry.Labels[key] = val
+				}
+			}
+			if err := c.ResolveLayers(root); err != nil {
+				entry.Error = err.Error()
+			} else {
+				entry.MountID = c.Layers[0].ID
+				entry.Layers = len(c.Layers)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// printList prints entries as a table, one per storage root
+func printList(w io.Writer, entries []listEntry) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	root := ""
+	for _, e := range entries {
+		if e.Root != root {
+			if root != "" {
+				fmt.Fprintln(tw)
+			}
+			root = e.Root
+			fmt.Fprintf(tw, "%s:\n", root)
+			fmt.Fprintln(tw, "TYPE\tID\tNAME\tIMAGE\tDRIVER\tSTATE\tMOUNT-ID\tLAYERS\tLABELS")
+		}
+		state := "live"
+		switch {
+		case e.Dead:
+			state = "dead"
+		case e.RemovalInProgress:
+			state = "removing"
+		}
+		mountID, layers := e.MountID, strconv.Itoa(e.Layers)
+		if e.Error != "" {
+			mountID, layers = "error: "+e.Error, "-"
+		}
+		var labels []string
+		for key, val := range e.Labels {
+			labels = append(labels, strings.TrimPrefix(key, hostapp.HOSTOS_BLOCKS_LABEL_PREFIX)+"="+val)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Type, shortID(e.ID), e.Name, shortID(strings.TrimPrefix(e.Image, "sha256:")),
+			e.Driver, state, mountID, layers, strings.Join(labels, ","))
+	}
+	tw.Flush()
+}
+
+// shortID truncates a container or image ID as docker ps does
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
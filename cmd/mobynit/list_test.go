@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListStorage(t *testing.T) {
+	sysroot := t.TempDir()
+	layerRoot := filepath.Join(sysroot, HOSTAPP_LAYER_ROOT)
+	writeLayeredContainer(t, layerRoot, "hostapp", map[string]string{
+		"io.balena.image.store": "root",
+		"org.example.other":     "hidden",
+	}, nil)
+	// Dead, and without layer metadata
+	writeHostappContainer(t, sysroot, "olddead", true)
+
+	for _, path := range []string{sysroot, layerRoot} {
+		entries, err := listStorage(path)
+		if err != nil {
+			t.Fatalf("listStorage(%s): %v", path, err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("expected 2 containers, got %+v", entries)
+		}
+		byID := map[string]listEntry{}
+		for _, e := range entries {
+			byID[e.ID] = e
+			if e.Root != layerRoot {
+				t.Errorf("expected storage root %s, got %s", layerRoot, e.Root)
+			}
+		}
+		live := byID["hostapp"]
+		if live.Dead || live.MountID != "hostapp-layer" || live.Layers != 1 || live.Type != "container" {
+			t.Errorf("unexpected entry %+v", live)
+		}
+		if len(live.Labels) != 1 || live.Labels["io.balena.image.store"] != "root" {
+			t.Errorf("expected only io.balena.image.* labels, got %v", live.Labels)
+		}
+		dead := byID["olddead"]
+		if !dead.Dead || dead.Error == "" {
+			t.Errorf("expected a dead container with a layer error, got %+v", dead)
+		}
+	}
+
+	if _, err := listStorage(t.TempDir()); err == nil {
+		t.Error("expected an error for a path without storage")
+	}
+}
+
+func TestRunList(t *testing.T) {
+	sysroot := t.TempDir()
+	writeLayeredContainer(t, filepath.Join(sysroot, HOSTAPP_LAYER_ROOT), "hostapp", map[string]string{"io.balena.image.class": "overlay"}, nil)
+
+	var out bytes.Buffer
+	if err := runList(&out, []string{sysroot}); err != nil {
+		t.Fatalf("runList: %v", err)
+	}
+	for _, want := range []string{"MOUNT-ID", "hostapp-layer", "class=overlay", "live"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in table:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := runList(&out, []string{"-json", sysroot}); err != nil {
+		t.Fatalf("runList: %v", err)
+	}
+	var entries []listEntry
+	if err := json.Unmarshal(out.Bytes(), &entries); err != nil || len(entries) != 1 || entries[0].Name != "hostapp" {
+		t.Errorf("unexpected JSON output %s (%v)", out.String(), err)
+	}
+}
@@ -5,7 +5,7 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -22,65 +23,6 @@ import (
 	"github.com/balena-os/hostapp"
 )
 
-// MountInfo represents a mount point from /proc/self/mountinfo
-type MountInfo struct {
-	Mountpoint string
-}
-
-// getMounts parses /proc/self/mountinfo and returns mount points
-func getMounts() ([]MountInfo, error) {
-	f, err := os.Open("/proc/self/mountinfo")
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	var mounts []MountInfo
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		// mountinfo format: ID PARENT_ID MAJOR:MINOR ROOT MOUNTPOINT OPTIONS...
-		// Fields are space-separated, mountpoint is field 5 (index 4)
-		fields := strings.Fields(scanner.Text())
-		if len(fields) < 5 {
-			continue
-		}
-		// Unescape octal sequences in mountpoint (e.g., \040 for space)
-		mountpoint := unescapeMountpoint(fields[4])
-		mounts = append(mounts, MountInfo{Mountpoint: mountpoint})
-	}
-	return mounts, scanner.Err()
-}
-
-// unescapeMountpoint handles octal escape sequences in mountinfo
-// Escaped chars: space(\040), tab(\011), newline(\012), backslash(\134)
-func unescapeMountpoint(s string) string {
-	if strings.IndexByte(s, '\\') == -1 {
-		return s
-	}
-
-	buf := make([]byte, len(s))
-	bufLen := 0
-	for i := 0; i < len(s); i++ {
-		if s[i] != '\\' || i+3 >= len(s) {
-			buf[bufLen] = s[i]
-			bufLen++
-			continue
-		}
-		// Check for valid octal escape \NNN
-		c1, c2, c3 := s[i+1], s[i+2], s[i+3]
-		if c1 >= '0' && c1 <= '7' && c2 >= '0' && c2 <= '7' && c3 >= '0' && c3 <= '7' {
-			v := (c1-'0')<<6 | (c2-'0')<<3 | (c3 - '0')
-			buf[bufLen] = v
-			bufLen++
-			i += 3
-		} else {
-			buf[bufLen] = s[i]
-			bufLen++
-		}
-	}
-	return string(buf[:bufLen])
-}
-
 const (
 	HOSTAPP_LAYER_ROOT       = "balena"
 	PIVOT_PATH               = "/mnt/sysroot/active"
@@ -88,15 +30,31 @@ const (
 	LOG_DIR                  = "/tmp/initramfs/"
 	LOG_FILE                 = "initramfs.debug"
 	CMDLINE_DISABLE_OVERLAYS = "mobynit.no_overlays"
+	CMDLINE_FLAT_OVERLAYS    = "mobynit.flat_overlays"
+	CMDLINE_VERIFY_LAYERS    = "mobynit.verify_layers"
+	CMDLINE_STRICT_CONTENT   = "mobynit.strict_content"
 	DATA_DIR_NAME            = "/mnt/data"
 	DATA_STATE_NAME          = "resin-data"
+	BOOT_STATE_NAME          = "resin-boot"
+	BOOT_FSTYPE              = "vfat"
+	BOOT_KERNEL_ABI_FILE     = "balena-kernel-abi"
+	BOOT_DEVICE_TYPE_FILE    = "device-type.json"
+	BOOT_MOUNT_PATH          = "/mnt/boot" // where the running system mounts it
 	DATA_LAYER_ROOT          = "docker"
+	DATA_STORAGE_LAYER_ROOT  = "containers/storage"
 	PURGE_MARKER_FILE        = "remove_me_to_reset"
+	SIGNING_KEYS_DIR         = "/etc/mobynit/keys"
 )
 
 /* Do not overlay images */
 var disable_overlays bool
 
+/* Build the root from every layer in one overlay instead of stacking overlays */
+var flat_overlays bool
+
+/* What OS blocks may hold, and how they are mounted */
+var content_policy hostapp.ContentPolicy
+
 /* Filesystem type for data partition */
 var dataFstype string
 
@@ -104,25 +62,303 @@ var dataFstype string
  * instead of being labelled. This allows for atomic hostapp updates
  * (just a rename on the symlink).
  */
-func mountSysroot(rootdir string) ([]hostapp.Container, error) {
-	var containers []hostapp.Container
-	current, err := os.Readlink(filepath.Join(rootdir, "current"))
+const (
+	CURRENT_LINK  = "current"
+	PREVIOUS_LINK = "previous"
+	FALLBACK_LINK = "fallback"
+	NEXT_LINK     = "next"
+)
+
+/* A hostapp staged behind the next symlink is booted on trial. The boot
+ * count file next to the symlinks records "<id> <boots>" and is bumped
+ * before the trial hostapp is mounted. Unless userspace confirms the boot
+ * with "mobynit commit", the trial is abandoned on the following boot.
+ */
+const (
+	BOOT_COUNT_FILE     = "next.boot-count"
+	TRIAL_BOOT_ATTEMPTS = 1
+)
+
+/* Exit codes of -sysroot -unmount */
+const (
+	EXIT_UNMOUNT_FAILED = 1
+	EXIT_NOT_MOUNTED    = 2
+	EXIT_BUSY           = 3
+)
+
+// hostappCandidate is a hostapp container mobynit may boot. Source names the
+// symlink it was found through, or "scan" for containers found in the layer
+// root. Err records why the candidate was rejected.
+type hostappCandidate struct {
+	Source string
+	ID     string
+	Err    error
+}
+
+// hostappCandidates returns the hostapps in rootdir in boot preference order:
+// the next (trial) symlink, the current symlink, then the previous and
+// fallback symlinks, then any other live hostapp container in the layer root.
+// Each ID is listed once, but for the trial hostapp: when next is rejected
+// its ID stays eligible under the other sources. Only the current symlink is
+// considered when fallback is false.
+func hostappCandidates(rootdir string, fallback bool) []hostappCandidate {
+	var candidates []hostappCandidate
+	seen := make(map[string]bool)
+	add := func(source, id string) {
+		if id == "" || seen[id] {
+			return
+		}
+		if source != NEXT_LINK {
+			seen[id] = true
+		}
+		candidates = append(candidates, hostappCandidate{Source: source, ID: id})
+	}
+
+	links := []string{CURRENT_LINK}
+	if fallback {
+		links = []string{NEXT_LINK, CURRENT_LINK, PREVIOUS_LINK, FALLBACK_LINK}
+	}
+	for _, link := range links {
+		target, err := os.Readlink(filepath.Join(rootdir, link))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Warning: reading %s symlink: %v", link, err)
+			}
+			continue
+		}
+		add(link, filepath.Base(target))
+	}
+
+	if !fallback {
+		return candidates
+	}
+
 	layerRoot := filepath.Join(rootdir, string(os.PathSeparator), HOSTAPP_LAYER_ROOT)
-	if err == nil {
-		cid := filepath.Base(current)
-		containers, err = hostapp.Mount(layerRoot, cid)
+	containers, err := hostapp.List(layerRoot)
+	if err != nil {
+		log.Printf("Warning: listing hostapp containers: %v", err)
+		return candidates
+	}
+	// Stable order so the scanned fallbacks are tried deterministically
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+	for _, c := range containers {
+		add("scan", c.ID)
+	}
+	return candidates
+}
+
+// mountSysroot mounts the first hostapp candidate in rootdir that mounts
+// successfully. With fallback disabled only the current hostapp is tried.
+// The returned candidates record the hostapp that was booted (the last one
+// with a nil Err) and why each candidate before it was rejected.
+func mountSysroot(rootdir string, fallback bool) ([]hostapp.Container, []hostappCandidate, error) {
+	candidates := hostappCandidates(rootdir, fallback)
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("No hostapp found in %s", rootdir)
+	}
+
+	layerRoot := filepath.Join(rootdir, string(os.PathSeparator), HOSTAPP_LAYER_ROOT)
+	for i := range candidates {
+		candidate := &candidates[i]
+		if candidate.Source == NEXT_LINK {
+			if err := startTrialBoot(rootdir, candidate.ID); err != nil {
+				candidate.Err = err
+				log.Printf("Rejected %s hostapp %s: %v", candidate.Source, candidate.ID, err)
+				abandonTrialBoot(rootdir)
+				continue
+			}
+		}
+		container, err := hostapp.MountID(layerRoot, candidate.ID)
 		if err != nil {
-			return nil, fmt.Errorf("Error mounting container with ID %s (len %d): %v", cid, len(containers), err)
+			if candidate.Source == NEXT_LINK {
+				abandonTrialBoot(rootdir)
+			}
+			candidate.Err = err
+			log.Printf("Rejected %s hostapp %s: %v", candidate.Source, candidate.ID, err)
+			continue
+		}
+		log.Printf("Booting %s hostapp %s", candidate.Source, candidate.ID)
+		return []hostapp.Container{container}, candidates[:i+1], nil
+	}
+	return nil, candidates, fmt.Errorf("No mountable hostapp among %d candidates", len(candidates))
+}
+
+// unmountSysroot unmounts the current hostapp in rootdir, as mounted by
+// mountSysroot with fallback disabled. Returns the process exit code.
+func unmountSysroot(rootdir string) int {
+	candidates := hostappCandidates(rootdir, false)
+	if len(candidates) == 0 {
+		log.Printf("Error unmounting sysroot: No hostapp found in %s", rootdir)
+		return EXIT_UNMOUNT_FAILED
+	}
+	layerRoot := filepath.Join(rootdir, string(os.PathSeparator), HOSTAPP_LAYER_ROOT)
+	// A preview holds the hostapp mount as a lowerdir
+	if root, err := hostapp.FindID(layerRoot, candidates[0].ID); err == nil {
+		if err := unmountPreview(previewPath(root.Layers)); err == nil {
+			log.Printf("Unmounted preview of hostapp %s", root.ID)
+		} else if !errors.Is(err, hostapp.ErrNotMounted) {
+			log.Printf("Warning: preview of hostapp %s: %v", root.ID, err)
+		}
+	}
+	container, err := hostapp.UnmountID(layerRoot, candidates[0].ID)
+	var busy *hostapp.BusyError
+	switch {
+	case err == nil:
+		log.Printf("Unmounted hostapp %s", container.ID)
+		return 0
+	case errors.Is(err, hostapp.ErrNotMounted):
+		log.Printf("Hostapp %s is not mounted: %v", candidates[0].ID, err)
+		return EXIT_NOT_MOUNTED
+	case errors.As(err, &busy):
+		log.Printf("Hostapp %s: %v", container.ID, err)
+		for _, holder := range busy.Holders {
+			log.Printf("Held by PID %d (%s)", holder.PID, holder.Command)
 		}
+		return EXIT_BUSY
+	default:
+		log.Printf("Error unmounting sysroot: %v", err)
+		return EXIT_UNMOUNT_FAILED
 	}
+}
 
-	if len(containers) != 1 {
-		return nil, fmt.Errorf("Invalid number of hostapp mounts: %d", len(containers))
+// readBootCount returns how many times the trial hostapp id has been booted.
+// A missing or unreadable count file, or one recorded for a different
+// hostapp, counts as zero boots.
+func readBootCount(rootdir, id string) int {
+	content, err := os.ReadFile(filepath.Join(rootdir, BOOT_COUNT_FILE))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) != 2 || fields[0] != id {
+		return 0
+	}
+	count, err := strconv.Atoi(fields[1])
+	if err != nil || count < 0 {
+		return 0
 	}
-	return containers, err
+	return count
 }
 
-func mountDataOverlays(newRootPath string) error {
+// writeBootCount durably records count boots of the trial hostapp id
+func writeBootCount(rootdir, id string, count int) error {
+	countPath := filepath.Join(rootdir, BOOT_COUNT_FILE)
+	tmpPath := countPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s %d\n", id, count); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, countPath); err != nil {
+		return err
+	}
+	return syncDir(rootdir)
+}
+
+// syncDir flushes directory entry changes (renames, new symlinks) to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// startTrialBoot counts a boot of the trial hostapp id. It fails when the
+// trial has used up its boots without being committed, or when the boot
+// cannot be counted: booting an uncounted trial could loop forever.
+func startTrialBoot(rootdir, id string) error {
+	count := readBootCount(rootdir, id)
+	if count >= TRIAL_BOOT_ATTEMPTS {
+		return fmt.Errorf("trial boot not committed after %d boots", count)
+	}
+	if err := writeBootCount(rootdir, id, count+1); err != nil {
+		return fmt.Errorf("recording trial boot: %v", err)
+	}
+	log.Printf("Trial boot %d/%d of hostapp %s", count+1, TRIAL_BOOT_ATTEMPTS, id)
+	return nil
+}
+
+// abandonTrialBoot removes the next symlink so later boots, and a later
+// commit, no longer consider the failed trial hostapp, then its boot count so
+// the same hostapp can be staged for another trial.
+func abandonTrialBoot(rootdir string) {
+	if err := os.Remove(filepath.Join(rootdir, NEXT_LINK)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: removing %s symlink: %v", NEXT_LINK, err)
+		return
+	}
+	if err := os.Remove(filepath.Join(rootdir, BOOT_COUNT_FILE)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: removing %s: %v", BOOT_COUNT_FILE, err)
+	}
+	if err := syncDir(rootdir); err != nil {
+		log.Printf("Warning: syncing %s: %v", rootdir, err)
+	}
+}
+
+// replaceSymlink atomically points the name symlink in dir at target
+func replaceSymlink(dir, name, target string) error {
+	tmpPath := filepath.Join(dir, name+".tmp")
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(target, tmpPath); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, name))
+}
+
+// commitTrialBoot confirms the trial hostapp in rootdir: next replaces
+// current, the old current becomes previous, and the boot count is cleared.
+// booted is the ID of the running hostapp, if known. A trial hostapp that was
+// never booted, as one staged since the last boot, is not committed.
+func commitTrialBoot(rootdir, booted string) error {
+	nextPath := filepath.Join(rootdir, NEXT_LINK)
+	next, err := os.Readlink(nextPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("No trial hostapp to commit in %s", rootdir)
+		}
+		return err
+	}
+	nextID := filepath.Base(next)
+	if booted != nextID && readBootCount(rootdir, nextID) < 1 {
+		return fmt.Errorf("Trial hostapp %s has not been booted", nextID)
+	}
+	if current, err := os.Readlink(filepath.Join(rootdir, CURRENT_LINK)); err == nil {
+		if filepath.Base(current) != nextID {
+			if err := replaceSymlink(rootdir, PREVIOUS_LINK, current); err != nil {
+				return fmt.Errorf("Error updating %s symlink: %v", PREVIOUS_LINK, err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(nextPath, filepath.Join(rootdir, CURRENT_LINK)); err != nil {
+		return fmt.Errorf("Error replacing %s symlink: %v", CURRENT_LINK, err)
+	}
+	if err := os.Remove(filepath.Join(rootdir, BOOT_COUNT_FILE)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := syncDir(rootdir); err != nil {
+		return err
+	}
+	log.Printf("Committed hostapp %s", nextID)
+	return nil
+}
+
+func mountDataOverlays(root hostapp.Container) error {
+	newRootPath := root.MountPath
 	device, err := os.Readlink(filepath.Join("/dev/disk/by-state/", DATA_STATE_NAME))
 	if err != nil {
 		return fmt.Errorf("No udev by-state resin-data symbolic link")
@@ -130,7 +366,9 @@ func mountDataOverlays(newRootPath string) error {
 	// As the /dev mount was moved this cannot be used directly
 	device = filepath.Join("/dev", string(os.PathSeparator), path.Base(device))
 	dataMountPath := filepath.Join(newRootPath, string(os.PathSeparator), DATA_DIR_NAME)
+	endPhase := report.phase("mount_data")
 	err = unix.Mount(device, dataMountPath, dataFstype, 0, "")
+	endPhase()
 	if err != nil {
 		return fmt.Errorf("Error mounting data partition: %v", err)
 	}
@@ -143,12 +381,42 @@ func mountDataOverlays(newRootPath string) error {
 		return nil
 	}
 
-	containers, err := hostapp.Mount(filepath.Join(newRootPath, string(os.PathSeparator), filepath.Join(DATA_DIR_NAME, string(os.PathSeparator), DATA_LAYER_ROOT)), HOSTOS_BLOCKS_CLASS)
+	endPhase = report.phase("mount_extensions")
+	containers, err := mountExtensions(dataMountPath)
+	endPhase()
 	if err != nil {
 		return err
 	}
+	report.addExtensions(containers)
+
+	if len(containers) == 0 {
+		return nil
+	}
+
+	endPhase = report.phase("select_extensions")
+	defer func() { endPhase() }()
+
+	// Extensions must be signed by a key baked into the initramfs or the
+	// hostapp, if either ships one
+	keys, err := hostapp.LoadPublicKeys(SIGNING_KEYS_DIR, filepath.Join(root.MountPath, SIGNING_KEYS_DIR))
+	if err != nil {
+		return fmt.Errorf("Error loading signing keys: %v", err)
+	}
+	containers = hostapp.SelectSigned(containers, keys)
+	if len(containers) == 0 {
+		log.Println("No signed extensions, skipping overlay")
+		return nil
+	}
 
+	containers = hostapp.SelectPermitted(containers, &root, content_policy)
 	if len(containers) == 0 {
+		log.Println("No extensions permitted by the content policy, skipping overlay")
+		return nil
+	}
+
+	containers = hostapp.SelectOSCompatible(containers, &root)
+	if len(containers) == 0 {
+		log.Println("No extensions compatible with the hostapp, skipping overlay")
 		return nil
 	}
 
@@ -162,20 +430,196 @@ func mountDataOverlays(newRootPath string) error {
 	if err != nil {
 		log.Printf("Warning: could not read /proc/cmdline: %v", err)
 	}
-	hostABIID := hostapp.ParseHostKernelABIID(string(cmdline))
+	hostABIID, source := hostapp.HostKernelABIID(string(cmdline), &root, release, readBootKernelABIID)
+	report.KernelABIID, report.KernelABISource = hostABIID, source
 
-	containers = hostapp.SelectMountable(containers, release, hostABIID)
+	host := hostapp.Host{Platform: root.Platform}
+	if host.DeviceType, err = readBootDeviceType(); err != nil {
+		log.Printf("Warning: could not get device type: %v", err)
+	}
+	containers = hostapp.SelectMountable(containers, release, hostABIID, host)
 	if len(containers) == 0 {
-		log.Println("No extensions compatible with running kernel, skipping overlay")
+		log.Println("No extensions compatible with the device and running kernel, skipping overlay")
 		return nil
 	}
 
+	// Lowerdirs are given relative to the data overlay2 directory the overlay
+	// is mounted from, so that more extensions fit in the options budget
+	mountDir := filepath.Join(dataMountPath, DATA_LAYER_ROOT, "overlay2")
+	relativePath := func(p string) string {
+		return relativeTo(mountDir, p)
+	}
+
+	endPhase()
+	endPhase = report.phase("mount_overlay")
+
+	mountPath := func(c hostapp.Container) string { return c.MountPath }
+	leftExtensions, rightExtensions, extensionIDs := overlayExtensions(root, containers, mountDir, mountPath, flat_overlays)
+
+	if flat_overlays {
+		lowerDirs, err := mountFlatOverlay(root, mountDir, leftExtensions, rightExtensions)
+		if err == nil {
+			report.FlatOverlay = true
+			report.placeExtensions(lowerDirs, leftExtensions, rightExtensions, extensionIDs)
+			return nil
+		}
+		log.Printf("Warning: flat overlay failed, stacking overlays instead: %v", err)
+		leftExtensions, rightExtensions, extensionIDs = overlayExtensions(root, containers, mountDir, mountPath, false)
+	}
+
+	lowerDirs := hostapp.BuildOverlayLowerDirs(relativePath(newRootPath), leftExtensions, rightExtensions, hostapp.OverlayOptionsLimit())
+
+	if err := hostapp.MountOverlayFrom(mountDir, newRootPath, lowerDirs); err != nil {
+		return fmt.Errorf("Error mounting image: %v", err)
+	}
+	report.placeExtensions(lowerDirs, leftExtensions, rightExtensions, extensionIDs)
+
+	return nil
+}
+
+// readBootKernelABIID reads the kernel ABI ID shipped in the boot
+// partition. A boot partition without one yields "".
+func readBootKernelABIID() (string, error) {
+	return readBootPartition(func(dir string) (string, error) {
+		return readKernelABIIDFile(filepath.Join(dir, BOOT_KERNEL_ABI_FILE))
+	})
+}
+
+// readBootDeviceType reads the device type slug from the boot partition
+func readBootDeviceType() (string, error) {
+	return readBootPartition(func(dir string) (string, error) {
+		return hostapp.ReadDeviceType(filepath.Join(dir, BOOT_DEVICE_TYPE_FILE))
+	})
+}
+
+// readBootPartition calls read on the boot partition, mounting it
+// read-only for the duration
+func readBootPartition(read func(dir string) (string, error)) (string, error) {
+	device, err := os.Readlink(filepath.Join("/dev/disk/by-state/", BOOT_STATE_NAME))
+	if err != nil {
+		return "", fmt.Errorf("No udev by-state %s symbolic link", BOOT_STATE_NAME)
+	}
+	device = filepath.Join("/dev", string(os.PathSeparator), path.Base(device))
+	dir, err := os.MkdirTemp("", "mobynit-boot")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(dir)
+	if err := unix.Mount(device, dir, BOOT_FSTYPE, unix.MS_RDONLY, ""); err != nil {
+		return "", fmt.Errorf("Error mounting boot partition: %v", err)
+	}
+	defer unix.Unmount(dir, 0)
+	return read(dir)
+}
+
+// runningDeviceType returns deviceType if set, else the device type slug
+// from the boot partition mounted at boot. An unknown device type is "",
+// which disables the device type filter.
+func runningDeviceType(boot, deviceType string) string {
+	if deviceType != "" {
+		return deviceType
+	}
+	deviceType, err := hostapp.ReadDeviceType(filepath.Join(boot, BOOT_DEVICE_TYPE_FILE))
+	if err != nil {
+		log.Printf("Warning: could not get device type: %v", err)
+	}
+	return deviceType
+}
+
+// readKernelABIIDFile reads a kernel ABI ID file, "" if there is none
+func readKernelABIIDFile(p string) (string, error) {
+	content, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// mountExtensions mounts the OS blocks of the data partition mounted at
+// dataMountPath
+func mountExtensions(dataMountPath string) ([]hostapp.Container, error) {
+	containers, err := hostapp.Mount(filepath.Join(dataMountPath, DATA_LAYER_ROOT), HOSTOS_BLOCKS_CLASS)
+	if err != nil {
+		return nil, err
+	}
+
+	// OS blocks may also be kept in a containers/storage (Podman) store
+	storageRoot := filepath.Join(dataMountPath, DATA_STORAGE_LAYER_ROOT)
+	if _, err := os.Stat(storageRoot); err == nil {
+		storageContainers, err := hostapp.Mount(storageRoot, HOSTOS_BLOCKS_CLASS)
+		if err != nil {
+			log.Printf("Warning: could not mount OS blocks from %s: %v", storageRoot, err)
+		}
+		containers = append(containers, storageContainers...)
+	}
+	return containers, nil
+}
+
+// findExtensions is mountExtensions without mounting: it resolves the
+// Layers of the OS blocks of the data partition at data
+func findExtensions(data string) ([]hostapp.Container, error) {
+	containers, err := hostapp.Find(filepath.Join(data, DATA_LAYER_ROOT), HOSTOS_BLOCKS_CLASS)
+	if err != nil {
+		return nil, err
+	}
+	storageRoot := filepath.Join(data, DATA_STORAGE_LAYER_ROOT)
+	if _, err := os.Stat(storageRoot); err == nil {
+		storageContainers, err := hostapp.Find(storageRoot, HOSTOS_BLOCKS_CLASS)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, storageContainers...)
+	}
+	return containers, nil
+}
+
+// relativeTo returns p relative to dir, or p if it cannot be made relative
+func relativeTo(dir, p string) string {
+	if rel, err := filepath.Rel(dir, p); err == nil {
+		return rel
+	}
+	return p
+}
+
+// overlayExtensions sorts OS blocks into the extensions mounted left and
+// right of the hostapp root, named by their mountPath relative to mountDir.
+// Extensions contribute their own layers, without those they share with the
+// hostapp, rather than their overlay mounts. Stacked, that is only when their
+// own layers hold no whiteouts or opaque directories, which would otherwise
+// hide files of the layers beside them; the rest keep their overlay mounts
+// of the whole layer chain. Also returns the container IDs by extension
+// mount path.
+func overlayExtensions(root hostapp.Container, containers []hostapp.Container, mountDir string, mountPath func(hostapp.Container) string, flat bool) ([]hostapp.Extension, []hostapp.Extension, map[string]string) {
+	layerLowerDirs := func(c hostapp.Container) []string {
+		layers := c.OwnLayers(&root)
+		if !flat {
+			if len(layers) == 0 {
+				return nil
+			}
+			deletes, err := hostapp.HasDeletions(layers)
+			if err != nil {
+				log.Printf("Warning: container %s: %v, stacking its overlay", c.Config.Name, err)
+				return nil
+			}
+			if deletes {
+				return nil
+			}
+		}
+		var dirs []string
+		for _, layer := range layers {
+			dirs = append(dirs, layer.LowerDir(mountDir))
+		}
+		return dirs
+	}
+
 	var leftExtensions, rightExtensions []hostapp.Extension
+	extensionIDs := make(map[string]string, len(containers))
 
 	for _, container := range containers {
-		if container.Config.Driver != "overlay2" {
-			return fmt.Errorf("Only overlay2 images supported, not %v", container.Config.Driver)
-		}
+		path := relativeTo(mountDir, mountPath(container))
+		extensionIDs[path] = container.ID
 		if overrideVal, ok := container.Labels[hostapp.HOSTOS_BLOCKS_OVERRIDE]; ok {
 			priority, err := strconv.Atoi(overrideVal)
 			if err != nil {
@@ -184,24 +628,43 @@ func mountDataOverlays(newRootPath string) error {
 			}
 			leftExtensions = append(leftExtensions, hostapp.Extension{
 				Name:      container.Config.Name,
-				MountPath: container.MountPath,
+				MountPath: path,
 				Priority:  priority,
+				LowerDirs: layerLowerDirs(container),
+				Requires:  container.Requires(),
 			})
 		} else {
 			rightExtensions = append(rightExtensions, hostapp.Extension{
 				Name:      container.Config.Name,
-				MountPath: container.MountPath,
+				MountPath: path,
+				LowerDirs: layerLowerDirs(container),
+				Requires:  container.Requires(),
 			})
 		}
 	}
+	return leftExtensions, rightExtensions, extensionIDs
+}
 
-	mountOptions := hostapp.BuildOverlayOptions(newRootPath, leftExtensions, rightExtensions)
-
-	if err := unix.Mount("overlay", newRootPath, "overlay", 0, mountOptions); err != nil {
-		return fmt.Errorf("Error mounting image: %v", err)
+// mountFlatOverlay mounts the new root as a single overlay of the layer
+// directories of the extensions and of the hostapp root, instead of stacking
+// an overlay on the hostapp and extension overlays. The extension overlays,
+// only needed for selection, end up hidden under the new root like the
+// hostapp overlay itself, and are no longer part of any lookup.
+func mountFlatOverlay(root hostapp.Container, mountDir string, leftExtensions, rightExtensions []hostapp.Extension) ([]string, error) {
+	if len(root.Layers) == 0 {
+		return nil, fmt.Errorf("No layers known for hostapp %s", root.ID)
+	}
+	var baseLowerDirs []string
+	for _, layer := range root.Layers {
+		baseLowerDirs = append(baseLowerDirs, layer.LowerDir(mountDir))
 	}
 
-	return nil
+	lowerDirs := hostapp.BuildFlatLowerDirs(baseLowerDirs, leftExtensions, rightExtensions, hostapp.OverlayOptionsLimit())
+	if err := hostapp.MountOverlayFrom(mountDir, root.MountPath, lowerDirs); err != nil {
+		return nil, err
+	}
+	log.Printf("Mounted flat overlay of %d layers", len(lowerDirs))
+	return lowerDirs, nil
 }
 
 func prepareForPivot() (string, error) {
@@ -219,8 +682,10 @@ func prepareForPivot() (string, error) {
 		}
 	}()
 
-	var containers []hostapp.Container
-	containers, err := mountSysroot(string(os.PathSeparator))
+	endPhase := report.phase("mount_sysroot")
+	containers, candidates, err := mountSysroot(string(os.PathSeparator), true)
+	endPhase()
+	report.setHostapp(containers, candidates)
 	if err != nil {
 		return "", fmt.Errorf("Error mounting sysroot: %v", err)
 	}
@@ -241,24 +706,104 @@ func prepareForPivot() (string, error) {
 	}
 
 	if !disable_overlays {
-		if err := mountDataOverlays(newRootPath); err != nil {
+		if err := mountDataOverlays(containers[0]); err != nil {
 			log.Print(err)
 		}
 	}
 	return newRootPath, nil
 }
 
+// cmdlineOptions are the mobynit options set on the kernel cmdline
+type cmdlineOptions struct {
+	disableOverlays bool
+	flatOverlays    bool
+	verifyLayers    bool
+	contentPolicy   hostapp.ContentPolicy
+}
+
+// parseCmdline reads the mobynit options from a kernel cmdline
+func parseCmdline(cmdline string) cmdlineOptions {
+	var options cmdlineOptions
+	for _, arg := range strings.Fields(cmdline) {
+		if strings.Contains(arg, "emergency") || strings.Contains(arg, CMDLINE_DISABLE_OVERLAYS) {
+			options.disableOverlays = true
+		}
+		if arg == CMDLINE_FLAT_OVERLAYS {
+			options.flatOverlays = true
+			options.contentPolicy.Flat = true
+		}
+		if arg == CMDLINE_VERIFY_LAYERS {
+			options.verifyLayers = true
+		}
+		if arg == CMDLINE_STRICT_CONTENT {
+			options.contentPolicy.NoSpecialFiles = true
+		}
+	}
+	return options
+}
+
 func main() {
 	sysrootPtr := flag.String("sysroot", "", "root of partition e.g. /mnt/sysroot/inactive. Mount destination is returned in stdout")
+	unmountPtr := flag.Bool("unmount", false, "with -sysroot, unmount the hostapp -sysroot mounted instead. Exits 2 if it was not mounted, 3 if it was busy and detached lazily")
+	previewPtr := flag.String("preview", "", "with -sysroot, data partition root e.g. /mnt/data whose OS blocks are mounted over the hostapp as the next boot would. The preview destination is returned in stdout instead")
 	flag.StringVar(&dataFstype, "dataFstype", "ext4", "Filesystem type for the data partition. Defaults to ext4.")
+	flag.BoolVar(&hostapp.VerifyLayers, "verify", false, "Verify layers against their recorded digests before mounting them")
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "commit":
+		commitCmd := flag.NewFlagSet("commit", flag.ExitOnError)
+		commitSysroot := commitCmd.String("sysroot", PIVOT_PATH, "root of the partition holding the trial hostapp")
+		commitCmd.Parse(flag.Args()[1:])
+		if err := commitTrialBoot(*commitSysroot, bootedHostapp(REPORT_DIR)); err != nil {
+			log.Fatalln("Error committing trial boot:", err)
+		}
+		return
+	case "list":
+		if err := runList(os.Stdout, flag.Args()[1:]); err != nil {
+			log.Fatalln("Error listing containers:", err)
+		}
+		return
+	case "check":
+		r, err := runCheck(os.Stdout, flag.Args()[1:])
+		if err != nil {
+			log.Fatalln("Error checking OS blocks:", err)
+		}
+		if dropped := r.requiredDropped(); len(dropped) > 0 {
+			for _, v := range dropped {
+				log.Printf("Required OS block %s would be dropped: %s", v.Name, v.Reason)
+			}
+			os.Exit(EXIT_REQUIRED_DROPPED)
+		}
+		return
+	case "plan":
+		if err := runPlan(os.Stdout, flag.Args()[1:]); err != nil {
+			log.Fatalln("Error planning boot:", err)
+		}
+		return
+	case "shadow":
+		if err := runShadow(os.Stdout, flag.Args()[1:]); err != nil {
+			log.Fatalln("Error reporting shadowed files:", err)
+		}
+		return
+	}
+
+	if sysrootPtr != nil && *sysrootPtr != "" && *unmountPtr {
+		os.Exit(unmountSysroot(*sysrootPtr))
+	}
 	if sysrootPtr != nil && *sysrootPtr != "" {
-		var containers []hostapp.Container
-		containers, err := mountSysroot(*sysrootPtr)
+		containers, _, err := mountSysroot(*sysrootPtr, false)
 		if err != nil {
 			log.Fatalln("Error mounting sysroot:", err)
 		}
+		if *previewPtr != "" {
+			target, err := mountPreview(containers[0], *previewPtr)
+			if err != nil {
+				log.Fatalln("Error mounting preview:", err)
+			}
+			fmt.Print(target)
+			return
+		}
 		fmt.Print(containers[0].MountPath)
 		return
 	}
@@ -279,16 +824,17 @@ func main() {
 	if err != nil {
 		log.Printf("warning: could not read /proc/cmdline: %v (overlay flags ignored)", err)
 	} else {
-		args := strings.Fields(string(content))
-		for _, arg := range args {
-			if strings.Contains(arg, "emergency") || strings.Contains(arg, CMDLINE_DISABLE_OVERLAYS) {
-				disable_overlays = true
-			}
+		options := parseCmdline(string(content))
+		disable_overlays = options.disableOverlays
+		flat_overlays = options.flatOverlays
+		content_policy = options.contentPolicy
+		if options.verifyLayers {
+			hostapp.VerifyLayers = true
 		}
 	}
 
 	// Any mounts done by initrd will be transfered in the new root
-	mounts, err := getMounts()
+	mounts, err := hostapp.ReadMountInfo()
 	if err != nil {
 		log.Fatalln("could not get mounts:", err)
 	}
@@ -297,17 +843,24 @@ func main() {
 		log.Fatalln("error remounting root as read/write:", err)
 	}
 
+	hostapp.Dropped = report.dropped
 	newRoot, err := prepareForPivot()
 	if err != nil {
 		log.Fatalln("Error preparing for pivot root:", err)
 	}
 
+	if dir, err := reportDir(newRoot, mounts); err != nil {
+		log.Println("Error writing boot report:", err)
+	} else if err := report.write(dir); err != nil {
+		log.Println(err)
+	}
+
 	for _, m := range mounts {
-		if m.Mountpoint == "/" {
+		if m.MountPoint == "/" {
 			continue
 		}
-		if err := unix.Mount(m.Mountpoint, filepath.Join(newRoot, m.Mountpoint), "", unix.MS_MOVE, ""); err != nil {
-			log.Println("could not move mountpoint:", m.Mountpoint, err)
+		if err := unix.Mount(m.MountPoint, filepath.Join(newRoot, m.MountPoint), "", unix.MS_MOVE, ""); err != nil {
+			log.Println("could not move mountpoint:", m.MountPoint, err)
 		}
 	}
 
@@ -3,234 +3,209 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
-
-	"golang.org/x/sys/unix"
 )
 
-func TestGetMounts_RealMounts(t *testing.T) {
-	if os.Getuid() != 0 {
-		t.Skip("requires root")
+// writeHostappContainer creates a minimal hostapp container config under
+// rootdir's layer root, without any overlay2 layer metadata.
+func writeHostappContainer(t *testing.T, rootdir, id string, dead bool) string {
+	t.Helper()
+	home := filepath.Join(rootdir, HOSTAPP_LAYER_ROOT, "containers", id)
+	if err := os.MkdirAll(home, 0755); err != nil {
+		t.Fatal(err)
 	}
-
-	// Create new mount namespace to isolate test mounts
-	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
-		t.Fatalf("failed to create mount namespace: %v", err)
+	cfg := `{"ID":"` + id + `","Name":"/` + id + `","Driver":"overlay2","State":{"Dead":` + strconv.FormatBool(dead) + `}}`
+	if err := os.WriteFile(filepath.Join(home, "config.v2.json"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
 	}
+	return home
+}
 
-	// Make mounts private so changes don't propagate
-	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
-		t.Fatalf("failed to make mounts private: %v", err)
+func candidateIDs(candidates []hostappCandidate) []string {
+	var ids []string
+	for _, c := range candidates {
+		ids = append(ids, c.Source+":"+c.ID)
 	}
+	return ids
+}
 
-	// Create and mount a tmpfs
-	tmpDir := t.TempDir()
-	if err := unix.Mount("tmpfs", tmpDir, "tmpfs", 0, ""); err != nil {
-		t.Fatalf("failed to mount tmpfs: %v", err)
+func TestHostappCandidates(t *testing.T) {
+	rootdir := t.TempDir()
+	current := writeHostappContainer(t, rootdir, "ccc", false)
+	previous := writeHostappContainer(t, rootdir, "ppp", false)
+	writeHostappContainer(t, rootdir, "aaa", false)
+	writeHostappContainer(t, rootdir, "ddd", true)
+	if err := os.Symlink(current, filepath.Join(rootdir, CURRENT_LINK)); err != nil {
+		t.Fatal(err)
 	}
-	defer unix.Unmount(tmpDir, 0)
-
-	mounts, err := getMounts()
-	if err != nil {
-		t.Fatalf("getMounts failed: %v", err)
+	if err := os.Symlink(previous, filepath.Join(rootdir, PREVIOUS_LINK)); err != nil {
+		t.Fatal(err)
 	}
-
-	found := false
-	for _, mount := range mounts {
-		if mount.Mountpoint == tmpDir {
-			found = true
-			break
-		}
+	// fallback duplicates current and must not be listed twice
+	if err := os.Symlink(current, filepath.Join(rootdir, FALLBACK_LINK)); err != nil {
+		t.Fatal(err)
 	}
 
-	if !found {
-		t.Errorf("expected tmpfs mount at %s to appear in mounts list", tmpDir)
+	got := candidateIDs(hostappCandidates(rootdir, true))
+	want := []string{"current:ccc", "previous:ppp", "scan:aaa"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, got)
 	}
-}
 
-func TestGetMounts_ParsesMultipleMounts(t *testing.T) {
-	mounts, err := getMounts()
-	if err != nil {
-		t.Fatalf("getMounts failed: %v", err)
+	got = candidateIDs(hostappCandidates(rootdir, false))
+	want = []string{"current:ccc"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("without fallback expected %v, got %v", want, got)
 	}
 
-	// Any system should have at least root and a few other mounts
-	if len(mounts) < 2 {
-		t.Errorf("expected at least 2 mounts, got %d", len(mounts))
+	// A trial of the current hostapp must not hide it once the trial expires
+	if err := os.Symlink(current, filepath.Join(rootdir, NEXT_LINK)); err != nil {
+		t.Fatal(err)
+	}
+	got = candidateIDs(hostappCandidates(rootdir, true))
+	want = []string{"next:ccc", "current:ccc", "previous:ppp", "scan:aaa"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("with a trial of current expected %v, got %v", want, got)
 	}
 }
 
-func TestGetMounts_NoDuplicateRoots(t *testing.T) {
-	mounts, err := getMounts()
-	if err != nil {
-		t.Fatalf("getMounts failed: %v", err)
+func TestMountSysrootRecordsRejections(t *testing.T) {
+	rootdir := t.TempDir()
+	current := writeHostappContainer(t, rootdir, "ccc", false)
+	writeHostappContainer(t, rootdir, "aaa", false)
+	if err := os.Symlink(current, filepath.Join(rootdir, CURRENT_LINK)); err != nil {
+		t.Fatal(err)
 	}
 
-	rootCount := 0
-	for _, mount := range mounts {
-		if mount.Mountpoint == "/" {
-			rootCount++
+	// Neither container has layer metadata, so both must be rejected
+	containers, candidates, err := mountSysroot(rootdir, true)
+	if err == nil {
+		t.Fatalf("expected error, got containers %+v", containers)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %v", candidateIDs(candidates))
+	}
+	for _, c := range candidates {
+		if c.Err == nil {
+			t.Errorf("candidate %s:%s should record a rejection reason", c.Source, c.ID)
 		}
 	}
 
-	if rootCount > 1 {
-		t.Errorf("root mount appeared %d times, expected 1", rootCount)
+	if _, _, err := mountSysroot(t.TempDir(), true); err == nil {
+		t.Error("expected error for a sysroot without hostapps")
 	}
 }
 
-func TestGetMounts_NestedMounts(t *testing.T) {
-	if os.Getuid() != 0 {
-		t.Skip("requires root")
+func TestTrialBootCount(t *testing.T) {
+	rootdir := t.TempDir()
+	if got := readBootCount(rootdir, "nnn"); got != 0 {
+		t.Errorf("missing count file: expected 0, got %d", got)
 	}
-
-	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
-		t.Fatalf("failed to create mount namespace: %v", err)
+	if err := startTrialBoot(rootdir, "nnn"); err != nil {
+		t.Fatalf("first trial boot: %v", err)
 	}
-
-	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
-		t.Fatalf("failed to make mounts private: %v", err)
+	if got := readBootCount(rootdir, "nnn"); got != 1 {
+		t.Errorf("expected 1 boot, got %d", got)
 	}
-
-	// Create nested mount structure
-	parentDir := t.TempDir()
-	childDir := filepath.Join(parentDir, "child")
-	if err := os.MkdirAll(childDir, 0755); err != nil {
-		t.Fatalf("failed to create child dir: %v", err)
+	// A count recorded for another hostapp does not apply to a newly staged one
+	if got := readBootCount(rootdir, "other"); got != 0 {
+		t.Errorf("count for another hostapp: expected 0, got %d", got)
 	}
-
-	if err := unix.Mount("tmpfs", parentDir, "tmpfs", 0, ""); err != nil {
-		t.Fatalf("failed to mount parent tmpfs: %v", err)
+	if err := startTrialBoot(rootdir, "nnn"); err == nil {
+		t.Error("expected exhausted trial to be rejected")
 	}
-	defer unix.Unmount(parentDir, unix.MNT_DETACH)
-
-	// Recreate child dir after mounting parent
-	if err := os.MkdirAll(childDir, 0755); err != nil {
-		t.Fatalf("failed to create child dir after mount: %v", err)
+	// Staging the same hostapp again after abandoning it starts a new trial
+	abandonTrialBoot(rootdir)
+	if err := startTrialBoot(rootdir, "nnn"); err != nil {
+		t.Errorf("expected the restaged trial to boot, got %v", err)
 	}
+}
 
-	if err := unix.Mount("tmpfs", childDir, "tmpfs", 0, ""); err != nil {
-		t.Fatalf("failed to mount child tmpfs: %v", err)
+func TestMountSysrootAbandonsTrial(t *testing.T) {
+	rootdir := t.TempDir()
+	next := writeHostappContainer(t, rootdir, "nnn", false)
+	current := writeHostappContainer(t, rootdir, "ccc", false)
+	if err := os.Symlink(next, filepath.Join(rootdir, NEXT_LINK)); err != nil {
+		t.Fatal(err)
 	}
-	defer unix.Unmount(childDir, unix.MNT_DETACH)
-
-	mounts, err := getMounts()
-	if err != nil {
-		t.Fatalf("getMounts failed: %v", err)
+	if err := os.Symlink(current, filepath.Join(rootdir, CURRENT_LINK)); err != nil {
+		t.Fatal(err)
 	}
 
-	parentFound, childFound := false, false
-	for _, mount := range mounts {
-		if mount.Mountpoint == parentDir {
-			parentFound = true
-		}
-		if mount.Mountpoint == childDir {
-			childFound = true
-		}
+	// The trial hostapp has no layer metadata so it fails to mount: the trial
+	// is abandoned along with its boot count.
+	_, candidates, _ := mountSysroot(rootdir, true)
+	if len(candidates) == 0 || candidates[0].Source != NEXT_LINK || candidates[0].Err == nil {
+		t.Fatalf("expected a rejected next candidate first, got %v", candidateIDs(candidates))
 	}
-
-	if !parentFound {
-		t.Error("expected parent mount to appear in mounts list")
+	if _, err := os.Lstat(filepath.Join(rootdir, NEXT_LINK)); !os.IsNotExist(err) {
+		t.Errorf("expected next symlink to be removed, got %v", err)
 	}
-	if !childFound {
-		t.Error("expected child mount to appear in mounts list")
+	if _, err := os.Stat(filepath.Join(rootdir, BOOT_COUNT_FILE)); !os.IsNotExist(err) {
+		t.Errorf("expected boot count file to be removed, got %v", err)
 	}
-}
 
-func TestGetMounts_ContainsStandardMounts(t *testing.T) {
-	mounts, err := getMounts()
-	if err != nil {
-		t.Fatalf("getMounts failed: %v", err)
-	}
-
-	// Build set for quick lookup
-	mountSet := make(map[string]bool)
-	for _, m := range mounts {
-		mountSet[m.Mountpoint] = true
-	}
-
-	// These should exist on any Linux system running tests
-	standardMounts := []string{"/", "/proc", "/sys"}
-	for _, expected := range standardMounts {
-		if !mountSet[expected] {
-			// Check if it might be a prefix match (sometimes paths are slightly different)
-			found := false
-			for m := range mountSet {
-				if strings.HasPrefix(m, expected) || expected == m {
-					found = true
-					break
-				}
-			}
-			if !found {
-				t.Errorf("expected standard mount %s not found", expected)
-			}
-		}
+	// Staged again, the same hostapp gets a new trial boot rather than being
+	// rejected as exhausted
+	if err := os.Symlink(next, filepath.Join(rootdir, NEXT_LINK)); err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestUnescapeMountpoint_NoEscape(t *testing.T) {
-	input := "/mnt/data"
-	result := unescapeMountpoint(input)
-	if result != input {
-		t.Errorf("expected %q, got %q", input, result)
+	_, candidates, _ = mountSysroot(rootdir, true)
+	if len(candidates) == 0 || candidates[0].Source != NEXT_LINK || candidates[0].Err == nil {
+		t.Fatalf("expected a rejected next candidate first, got %v", candidateIDs(candidates))
 	}
-}
-
-func TestUnescapeMountpoint_Space(t *testing.T) {
-	// \040 is octal for space (32)
-	input := "/mnt/my\\040data"
-	expected := "/mnt/my data"
-	result := unescapeMountpoint(input)
-	if result != expected {
-		t.Errorf("expected %q, got %q", expected, result)
+	if strings.Contains(candidates[0].Err.Error(), "not committed") {
+		t.Errorf("expected the restaged trial to be booted, got %v", candidates[0].Err)
 	}
 }
 
-func TestUnescapeMountpoint_Tab(t *testing.T) {
-	// \011 is octal for tab (9)
-	input := "/mnt/my\\011data"
-	expected := "/mnt/my\tdata"
-	result := unescapeMountpoint(input)
-	if result != expected {
-		t.Errorf("expected %q, got %q", expected, result)
-	}
-}
+func TestCommitTrialBoot(t *testing.T) {
+	rootdir := t.TempDir()
+	next := writeHostappContainer(t, rootdir, "nnn", false)
+	current := writeHostappContainer(t, rootdir, "ccc", false)
 
-func TestUnescapeMountpoint_Backslash(t *testing.T) {
-	// \134 is octal for backslash (92)
-	input := "/mnt/my\\134data"
-	expected := "/mnt/my\\data"
-	result := unescapeMountpoint(input)
-	if result != expected {
-		t.Errorf("expected %q, got %q", expected, result)
+	if err := commitTrialBoot(rootdir, ""); err == nil {
+		t.Error("expected error without a next symlink")
 	}
-}
 
-func TestUnescapeMountpoint_Multiple(t *testing.T) {
-	// Multiple escapes
-	input := "/mnt/my\\040data\\040here"
-	expected := "/mnt/my data here"
-	result := unescapeMountpoint(input)
-	if result != expected {
-		t.Errorf("expected %q, got %q", expected, result)
+	if err := os.Symlink(next, filepath.Join(rootdir, NEXT_LINK)); err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestUnescapeMountpoint_InvalidOctal(t *testing.T) {
-	// Invalid octal (not 3 digits) should be left as-is
-	input := "/mnt/my\\04data"
-	result := unescapeMountpoint(input)
-	// Should preserve the backslash since it's not a valid 3-digit octal
-	if result != input {
-		t.Errorf("expected %q (unchanged), got %q", input, result)
+	if err := os.Symlink(current, filepath.Join(rootdir, CURRENT_LINK)); err != nil {
+		t.Fatal(err)
+	}
+	// A trial staged since the last boot has not run yet
+	if err := commitTrialBoot(rootdir, "ccc"); err == nil {
+		t.Error("expected error for a trial hostapp that was never booted")
+	}
+	if _, err := os.Lstat(filepath.Join(rootdir, NEXT_LINK)); err != nil {
+		t.Errorf("next symlink should be left in place, got %v", err)
+	}
+	if err := writeBootCount(rootdir, "other", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitTrialBoot(rootdir, ""); err == nil {
+		t.Error("expected error for a boot recorded for another hostapp")
+	}
+	if err := startTrialBoot(rootdir, "nnn"); err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestUnescapeMountpoint_TrailingBackslash(t *testing.T) {
-	// Backslash at end without enough chars
-	input := "/mnt/data\\"
-	result := unescapeMountpoint(input)
-	if result != input {
-		t.Errorf("expected %q (unchanged), got %q", input, result)
+	if err := commitTrialBoot(rootdir, ""); err != nil {
+		t.Fatalf("commitTrialBoot: %v", err)
+	}
+	if target, _ := os.Readlink(filepath.Join(rootdir, CURRENT_LINK)); target != next {
+		t.Errorf("current should point to %s, got %s", next, target)
+	}
+	if target, _ := os.Readlink(filepath.Join(rootdir, PREVIOUS_LINK)); target != current {
+		t.Errorf("previous should point to %s, got %s", current, target)
+	}
+	if _, err := os.Lstat(filepath.Join(rootdir, NEXT_LINK)); !os.IsNotExist(err) {
+		t.Errorf("next symlink should be gone, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootdir, BOOT_COUNT_FILE)); !os.IsNotExist(err) {
+		t.Errorf("boot count file should be removed, got %v", err)
 	}
 }
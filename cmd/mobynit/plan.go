@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/balena-os/hostapp"
+)
+
+// planOptions override what a boot would read from the running system
+type planOptions struct {
+	sysroot   string
+	data      string
+	release   string
+	hostABIID string
+	// pageSize limits the mount options as mount(2) does; 0 means no limit
+	pageSize int
+	cmdline  string
+	keysDir  string
+	// deviceType is the device type slug; "" disables the device type filter
+	deviceType string
+	// boot is where the boot partition is mounted, "" if it is not
+	boot string
+}
+
+// runPlan implements the plan subcommand: it prints the overlay stack a
+// boot would build, without mounting anything
+func runPlan(w io.Writer, args []string) error {
+	options, asJSON, err := parsePlanOptions("plan", args)
+	if err != nil {
+		return err
+	}
+	r, lowerDirs, err := plan(options)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		content, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(content))
+		return err
+	}
+	printPlan(w, r, lowerDirs)
+	return nil
+}
+
+// parsePlanOptions parses the options of the plan subcommand, or of another
+// subcommand name that plans a boot, and whether to print JSON
+func parsePlanOptions(name string, args []string) (planOptions, bool, error) {
+	planCmd := flag.NewFlagSet(name, flag.ExitOnError)
+	sysroot := planCmd.String("sysroot", PIVOT_PATH, "root of the partition holding the hostapps")
+	data := planCmd.String("data", DATA_DIR_NAME, "root of the data partition")
+	release := planCmd.String("kernel-release", "", "kernel release to plan for (default: running kernel)")
+	hostABIID := planCmd.String("abi-id", "", "host kernel ABI ID (default: from the cmdline, else the hostapp)")
+	pageSize := planCmd.Int("page-size", 0, "page size limiting the mount options (default: this system's limit, -1: none)")
+	cmdline := planCmd.String("cmdline", "", "kernel cmdline (default: /proc/cmdline)")
+	keysDir := planCmd.String("keys", "", "directory of extension signing keys, besides the hostapp's")
+	deviceType := planCmd.String("device-type", "", "device type slug (default: from the boot partition)")
+	boot := planCmd.String("boot", BOOT_MOUNT_PATH, "mount point of the boot partition, for the kernel ABI ID and device type")
+	asJSON := planCmd.Bool("json", false, "print JSON")
+	planCmd.Parse(args)
+
+	options := planOptions{
+		sysroot:    *sysroot,
+		data:       *data,
+		release:    *release,
+		hostABIID:  *hostABIID,
+		cmdline:    *cmdline,
+		keysDir:    *keysDir,
+		deviceType: runningDeviceType(*boot, *deviceType),
+		boot:       *boot,
+	}
+	if options.release == "" {
+		var err error
+		if options.release, err = hostapp.GetKernelRelease(); err != nil {
+			return options, false, fmt.Errorf("Error getting kernel release: %v", err)
+		}
+	}
+	if options.cmdline == "" {
+		content, err := os.ReadFile("/proc/cmdline")
+		if err != nil {
+			return options, false, fmt.Errorf("Error reading /proc/cmdline: %v", err)
+		}
+		options.cmdline = string(content)
+	}
+	switch {
+	case *pageSize > 0:
+		options.pageSize = *pageSize
+	case *pageSize == 0 && hostapp.OverlayOptionsLimit() > 0:
+		options.pageSize = os.Getpagesize()
+	}
+	return options, *asJSON, nil
+}
+
+// plan runs the boot's hostapp and OS block selection on unmounted
+// containers. Returns the boot report the boot would write, and the
+// lowerdirs of its root overlay, relative to the data overlay2 directory.
+func plan(options planOptions) (*bootReport, []string, error) {
+	r := &bootReport{}
+
+	// Layers are verified as the boot would before mounting them
+	cmdline := parseCmdline(options.cmdline)
+	if cmdline.verifyLayers && !hostapp.VerifyLayers {
+		hostapp.VerifyLayers = true
+		defer func() { hostapp.VerifyLayers = false }()
+	}
+
+	// Hostapp: the first candidate whose layers resolve. A trial hostapp
+	// that used up its boots would be rejected.
+	layerRoot := filepath.Join(options.sysroot, HOSTAPP_LAYER_ROOT)
+	candidates := hostappCandidates(options.sysroot, true)
+	var hostapps []hostapp.Container
+	for i := range candidates {
+		candidate := &candidates[i]
+		if candidate.Source == NEXT_LINK {
+			if count := readBootCount(options.sysroot, candidate.ID); count >= TRIAL_BOOT_ATTEMPTS {
+				candidate.Err = fmt.Errorf("trial boot not committed after %d boots", count)
+				continue
+			}
+		}
+		root, err := hostapp.FindID(layerRoot, candidate.ID)
+		if err != nil {
+			candidate.Err = err
+			continue
+		}
+		hostapps = []hostapp.Container{root}
+		candidates = candidates[:i+1]
+		break
+	}
+	r.setHostapp(hostapps, candidates)
+	if len(hostapps) == 0 {
+		return r, nil, fmt.Errorf("No usable hostapp among %d candidates", len(candidates))
+	}
+	root := hostapps[0]
+
+	mountDir := filepath.Join(options.data, DATA_LAYER_ROOT, "overlay2")
+	// Containers would be mounted on the merged directory of their layer
+	mountPath := func(c hostapp.Container) string {
+		return filepath.Join(filepath.Dir(c.Layers[0].DiffPath), "merged")
+	}
+	rootLowerDirs := []string{relativeTo(mountDir, mountPath(root))}
+
+	if _, err := os.Stat(filepath.Join(options.data, PURGE_MARKER_FILE)); cmdline.disableOverlays || err != nil {
+		r.placeExtensions(rootLowerDirs, nil, nil, nil)
+		return r, rootLowerDirs, nil
+	}
+
+	hostapp.Dropped = r.dropped
+	defer func() { hostapp.Dropped = nil }()
+	containers, err := findExtensions(options.data)
+	if err != nil {
+		return r, nil, err
+	}
+	r.addExtensions(containers)
+
+	keys, err := signingKeys(root, options.keysDir)
+	if err != nil {
+		return r, nil, err
+	}
+	containers = hostapp.SelectSigned(containers, keys)
+	containers = hostapp.SelectPermitted(containers, &root, cmdline.contentPolicy)
+	containers = hostapp.SelectOSCompatible(containers, &root)
+	hostABIID, source := options.hostABIID, "override"
+	if hostABIID == "" {
+		var bootABIID func() (string, error)
+		if options.boot != "" {
+			bootABIID = func() (string, error) {
+				return readKernelABIIDFile(filepath.Join(options.boot, BOOT_KERNEL_ABI_FILE))
+			}
+		}
+		hostABIID, source = hostapp.HostKernelABIID(options.cmdline, &root, options.release, bootABIID)
+	}
+	r.KernelABIID, r.KernelABISource = hostABIID, source
+	host := hostapp.Host{Platform: root.Platform, DeviceType: options.deviceType}
+	containers = hostapp.SelectMountable(containers, options.release, hostABIID, host)
+
+	left, right, ids := overlayExtensions(root, containers, mountDir, mountPath, cmdline.flatOverlays)
+	limit := options.pageSize - 1
+	var lowerDirs []string
+	if cmdline.flatOverlays {
+		var baseLowerDirs []string
+		for _, layer := range root.Layers {
+			baseLowerDirs = append(baseLowerDirs, layer.LowerDir(mountDir))
+		}
+		lowerDirs = hostapp.BuildFlatLowerDirs(baseLowerDirs, left, right, limit)
+		r.FlatOverlay = true
+	} else {
+		lowerDirs = hostapp.BuildOverlayLowerDirs(rootLowerDirs[0], left, right, limit)
+	}
+	r.placeExtensions(lowerDirs, left, right, ids)
+	return r, lowerDirs, nil
+}
+
+// printPlan prints the selection recorded in r and the overlay stack
+func printPlan(w io.Writer, r *bootReport, lowerDirs []string) {
+	fmt.Fprintln(w, "Hostapp candidates:")
+	for _, c := range r.HostappCandidates {
+		status := "selected"
+		if c.Error != "" {
+			status = "rejected: " + c.Error
+		}
+		fmt.Fprintf(w, "  %s %s: %s\n", c.Source, c.ID, status)
+	}
+
+	if len(r.Extensions) > 0 {
+		fmt.Fprintln(w, "OS blocks:")
+	}
+	for _, e := range r.Extensions {
+		status := "kept"
+		if !e.Kept {
+			status = "dropped: " + e.DropReason
+		}
+		fmt.Fprintf(w, "  %s (%s): %s\n", e.Name, e.ID, status)
+	}
+
+	stacked := []*reportContainer{r.Hostapp}
+	for _, e := range r.Extensions {
+		if e.Position != nil {
+			stacked = append(stacked, e)
+		}
+	}
+	sort.Slice(stacked, func(i, j int) bool { return *stacked[i].Position < *stacked[j].Position })
+	fmt.Fprintln(w, "Overlay stack, highest precedence first:")
+	for _, e := range stacked {
+		kind := "extension"
+		if e == r.Hostapp {
+			kind = "hostapp"
+		}
+		fmt.Fprintf(w, "  [%d] %s (%s)\n", *e.Position, e.Name, kind)
+	}
+	fmt.Fprintln(w, "Lowerdirs:")
+	for _, dir := range lowerDirs {
+		fmt.Fprintf(w, "  %s\n", dir)
+	}
+}
+
+// signingKeys loads the OS block signing keys in keysDir, if set, and in the
+// unmounted hostapp root's SIGNING_KEYS_DIR
+func signingKeys(root hostapp.Container, keysDir string) ([]ed25519.PublicKey, error) {
+	keyDirs := []string{}
+	if keysDir != "" {
+		keyDirs = append(keyDirs, keysDir)
+	}
+	if dir, err := root.Path(SIGNING_KEYS_DIR); err == nil {
+		keyDirs = append(keyDirs, dir)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return hostapp.LoadPublicKeys(keyDirs...)
+}
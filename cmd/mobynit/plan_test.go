@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/balena-os/hostapp"
+)
+
+// writeLayeredContainer creates a container with a single overlay2 layer
+// holding files, where a value starting with "->" is a symlink, under
+// layerRoot. Returns the container's home directory.
+func writeLayeredContainer(t *testing.T, layerRoot, id string, labels map[string]string, files map[string]string) string {
+	t.Helper()
+	home := filepath.Join(layerRoot, "containers", id)
+	if err := os.MkdirAll(home, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := json.Marshal(map[string]interface{}{
+		"ID": id, "Name": id, "Driver": "overlay2",
+		"Config": map[string]interface{}{"Labels": labels},
+	})
+	if err := os.WriteFile(filepath.Join(home, "config.v2.json"), cfg, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layerID := id + "-layer"
+	mountIDDir := filepath.Join(layerRoot, "image", "overlay2", "layerdb", "mounts", id)
+	if err := os.MkdirAll(mountIDDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mountIDDir, "mount-id"), []byte(layerID), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diff := filepath.Join(layerRoot, "overlay2", layerID, "diff")
+	if err := os.MkdirAll(diff, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(diff, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if target, ok := strings.CutPrefix(content, "->"); ok {
+			if err := os.Symlink(target, path); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return home
+}
+
+// writePlanFixture lays out a sysroot with a current hostapp and a data
+// partition with OS blocks: two that fit the kernel, one built for another
+// kernel version and one carrying modules for another kernel ABI.
+func writePlanFixture(t *testing.T) planOptions {
+	t.Helper()
+	sysroot := t.TempDir()
+	data := t.TempDir()
+	home := writeLayeredContainer(t, filepath.Join(sysroot, HOSTAPP_LAYER_ROOT), "hostapp", nil, map[string]string{"etc/issue": "balenaOS"})
+	if err := os.Symlink(home, filepath.Join(sysroot, CURRENT_LINK)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data, PURGE_MARKER_FILE), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dockerRoot := filepath.Join(data, DATA_LAYER_ROOT)
+	class := map[string]string{HOSTOS_BLOCKS_CLASS: "overlay"}
+	writeLayeredContainer(t, dockerRoot, "early", map[string]string{HOSTOS_BLOCKS_CLASS: "overlay", hostapp.HOSTOS_BLOCKS_OVERRIDE: "1"}, nil)
+	writeLayeredContainer(t, dockerRoot, "late", class, nil)
+	writeLayeredContainer(t, dockerRoot, "oldkernel", map[string]string{HOSTOS_BLOCKS_CLASS: "overlay", hostapp.HOSTOS_BLOCKS_KERNEL_VERSION: "5.0.0"}, nil)
+	// Modules are found through the merged-usr lib symlink
+	writeLayeredContainer(t, dockerRoot, "modules", class, map[string]string{
+		"lib": "->usr/lib",
+		"usr/lib/modules/6.1.0-test/Module.symvers": "symbols",
+	})
+	writeLayeredContainer(t, dockerRoot, "unrelated", nil, nil)
+
+	return planOptions{
+		sysroot:   sysroot,
+		data:      data,
+		release:   "6.1.0-test",
+		hostABIID: "host-abi",
+	}
+}
+
+func TestPlan(t *testing.T) {
+	options := writePlanFixture(t)
+	r, lowerDirs, err := plan(options)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+
+	if r.Hostapp == nil || r.Hostapp.ID != "hostapp" || *r.Hostapp.Position != 1 {
+		t.Fatalf("unexpected hostapp %+v", r.Hostapp)
+	}
+	got := map[string]string{}
+	for _, e := range r.Extensions {
+		switch {
+		case e.Position != nil:
+			got[e.ID] = string(rune('0' + *e.Position))
+		case !e.Kept:
+			got[e.ID] = e.DropReason
+		}
+	}
+	if got["early"] != "0" || got["late"] != "2" {
+		t.Errorf("unexpected positions %v", got)
+	}
+	if !strings.Contains(got["oldkernel"], "kernel version") {
+		t.Errorf("expected oldkernel to be dropped for its kernel version, got %q", got["oldkernel"])
+	}
+	if !strings.Contains(got["modules"], "kernel ABI ID") {
+		t.Errorf("expected modules to be dropped for its kernel ABI, got %q", got["modules"])
+	}
+	if _, ok := got["unrelated"]; ok || len(r.Extensions) != 4 {
+		t.Errorf("expected 4 OS blocks, got %+v", got)
+	}
+
+	// Extensions without whiteouts are stacked from their own layers
+	wantDirs := []string{"early-layer/diff", relativeTo(filepath.Join(options.data, DATA_LAYER_ROOT, "overlay2"),
+		filepath.Join(options.sysroot, HOSTAPP_LAYER_ROOT, "overlay2", "hostapp-layer", "merged")), "late-layer/diff"}
+	if strings.Join(lowerDirs, ":") != strings.Join(wantDirs, ":") {
+		t.Errorf("expected lowerdirs %v, got %v", wantDirs, lowerDirs)
+	}
+
+	var out bytes.Buffer
+	printPlan(&out, r, lowerDirs)
+	for _, line := range []string{"current hostapp: selected", "oldkernel (oldkernel): dropped:", "[0] early (extension)", "[1] hostapp (hostapp)", "[2] late (extension)"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in plan output:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestPlanOverrides(t *testing.T) {
+	options := writePlanFixture(t)
+
+	// The module-carrying extension fits a kernel with its ABI
+	sum := sha256.Sum256([]byte("symbols"))
+	options.hostABIID = hex.EncodeToString(sum[:])
+	r, _, err := plan(options)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	for _, e := range r.Extensions {
+		if e.ID == "modules" && e.Position == nil {
+			t.Errorf("expected modules to be kept for a matching ABI: %+v", e)
+		}
+	}
+
+	// Without an ABI ID on the cmdline, the hostapp's kernel modules give it
+	options = writePlanFixture(t)
+	options.hostABIID = ""
+	writeHostappKernel(t, options.sysroot, options.release, "symbols")
+	if r, _, err = plan(options); err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if r.KernelABIID != hex.EncodeToString(sum[:]) || r.KernelABISource != hostapp.KERNEL_ABI_SOURCE_HOSTAPP {
+		t.Errorf("expected the hostapp's kernel ABI ID, got %q from %q", r.KernelABIID, r.KernelABISource)
+	}
+	for _, e := range r.Extensions {
+		if e.ID == "modules" && e.Position == nil {
+			t.Errorf("expected modules to be kept for the hostapp's ABI: %+v", e)
+		}
+	}
+
+	// Then the boot partition's, as a boot reads it
+	options = writePlanFixture(t)
+	options.hostABIID = ""
+	options.boot = t.TempDir()
+	if err := os.WriteFile(filepath.Join(options.boot, BOOT_KERNEL_ABI_FILE), []byte(hex.EncodeToString(sum[:])+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if r, _, err = plan(options); err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if r.KernelABIID != hex.EncodeToString(sum[:]) || r.KernelABISource != hostapp.KERNEL_ABI_SOURCE_BOOT {
+		t.Errorf("expected the boot partition's kernel ABI ID, got %q from %q", r.KernelABIID, r.KernelABISource)
+	}
+
+	// Layers are verified when the cmdline asks for it: the fixture's carry
+	// no recorded digests
+	options = writePlanFixture(t)
+	options.cmdline = CMDLINE_VERIFY_LAYERS
+	if _, _, err = plan(options); err == nil {
+		t.Error("expected the unverifiable hostapp to be rejected")
+	}
+	if hostapp.VerifyLayers {
+		t.Error("expected layer verification to be reset after planning")
+	}
+
+	// An OS block requiring one dropped for its kernel ABI is dropped too
+	options = writePlanFixture(t)
+	writeLayeredContainer(t, filepath.Join(options.data, DATA_LAYER_ROOT), "late",
+		map[string]string{HOSTOS_BLOCKS_CLASS: "overlay", hostapp.HOSTOS_BLOCKS_REQUIRES: "modules"}, nil)
+	if r, _, err = plan(options); err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	for _, e := range r.Extensions {
+		if e.ID == "late" && (e.Position != nil || e.DropReason != `requires "modules", which is not available`) {
+			t.Errorf("expected late to be dropped with modules, got %+v", e)
+		}
+	}
+
+	// A normal OS block may not delete hostapp files, and the cmdline
+	// forbids setuid files in any
+	options = writePlanFixture(t)
+	options.cmdline = CMDLINE_STRICT_CONTENT
+	dockerRoot := filepath.Join(options.data, DATA_LAYER_ROOT)
+	writeLayeredContainer(t, dockerRoot, "late", map[string]string{HOSTOS_BLOCKS_CLASS: "overlay"}, map[string]string{"etc/.wh.issue": ""})
+	writeLayeredContainer(t, dockerRoot, "early", map[string]string{HOSTOS_BLOCKS_CLASS: "overlay", hostapp.HOSTOS_BLOCKS_OVERRIDE: "1"}, map[string]string{"usr/bin/su": "su"})
+	if err := os.Chmod(filepath.Join(dockerRoot, "overlay2", "early-layer", "diff", "usr/bin/su"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if r, _, err = plan(options); err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	for _, e := range r.Extensions {
+		if e.ID == "late" && e.DropReason != "content policy: whiteout /etc/.wh.issue in layer late-layer" {
+			t.Errorf("expected late to be dropped for its whiteout, got %+v", e)
+		}
+		if e.ID == "early" && e.DropReason != "content policy: setuid file /usr/bin/su in layer early-layer" {
+			t.Errorf("expected early to be dropped for its setuid file, got %+v", e)
+		}
+	}
+
+	// An override block's whiteouts only hide files within its overlay mount
+	options = writePlanFixture(t)
+	writeLayeredContainer(t, filepath.Join(options.data, DATA_LAYER_ROOT), "early",
+		map[string]string{HOSTOS_BLOCKS_CLASS: "overlay", hostapp.HOSTOS_BLOCKS_OVERRIDE: "1"}, map[string]string{"etc/.wh.motd": ""})
+	_, lowerDirs, err := plan(options)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if len(lowerDirs) == 0 || lowerDirs[0] != "early-layer/merged" {
+		t.Errorf("expected early to be stacked as its overlay mount, got %v", lowerDirs)
+	}
+
+	// A small page fits no right extension
+	options = writePlanFixture(t)
+	options.pageSize = len("lowerdir=early-layer/diff:") + len(relativeTo(filepath.Join(options.data, DATA_LAYER_ROOT, "overlay2"),
+		filepath.Join(options.sysroot, HOSTAPP_LAYER_ROOT, "overlay2", "hostapp-layer", "merged"))) + 2
+	r, _, err = plan(options)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	for _, e := range r.Extensions {
+		if e.ID == "late" && e.DropReason != "page size limit" {
+			t.Errorf("expected late to be cut by the page size, got %+v", e)
+		}
+	}
+
+	// Overlays disabled on the cmdline
+	options = writePlanFixture(t)
+	options.cmdline = "console=ttyS0 " + CMDLINE_DISABLE_OVERLAYS
+	r, lowerDirs, err = plan(options)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if len(lowerDirs) != 1 || len(r.Extensions) != 0 || *r.Hostapp.Position != 0 {
+		t.Errorf("expected the hostapp alone, got %v", lowerDirs)
+	}
+}
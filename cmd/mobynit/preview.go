@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/balena-os/hostapp"
+)
+
+// PREVIEW_DIR is where the preview of a hostapp's root is mounted, next to
+// the merged directory of its overlay2 layer. PREVIEW_MOUNTS_FILE, next to
+// it, lists the OS block mounts the preview made, one per line, for them to
+// be unmounted with it.
+const (
+	PREVIEW_DIR         = "preview"
+	PREVIEW_MOUNTS_FILE = "preview.mounts"
+)
+
+// previewPath returns where the preview of the hostapp with the given
+// layers is mounted
+func previewPath(layers []hostapp.Layer) string {
+	return filepath.Join(filepath.Dir(layers[0].DiffPath), PREVIEW_DIR)
+}
+
+// unmountPreview unmounts the preview at target and the OS block mounts it
+// made. Returns hostapp.ErrNotMounted if no preview is mounted.
+func unmountPreview(target string) error {
+	err := hostapp.Unmount(target)
+	if err != nil && !errors.Is(err, hostapp.ErrNotMounted) {
+		return err
+	}
+	mountsPath := filepath.Join(filepath.Dir(target), PREVIEW_MOUNTS_FILE)
+	content, readErr := os.ReadFile(mountsPath)
+	if readErr != nil {
+		if !os.IsNotExist(readErr) {
+			log.Printf("Warning: reading preview mounts: %v", readErr)
+		}
+		return err
+	}
+	for _, mountPath := range strings.Fields(string(content)) {
+		if err := hostapp.Unmount(mountPath); err != nil && !errors.Is(err, hostapp.ErrNotMounted) {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	if err := os.Remove(mountsPath); err != nil {
+		log.Printf("Warning: removing %s: %v", mountsPath, err)
+	}
+	return err
+}
+
+// recordPreviewMounts writes the mounts of containers not in mounted, the
+// mount table before they were mounted, as the preview's own
+func recordPreviewMounts(target string, containers []hostapp.Container, mounted []hostapp.MountEntry) error {
+	existing := make(map[string]bool, len(mounted))
+	for _, m := range mounted {
+		existing[m.MountPoint] = true
+	}
+	var b strings.Builder
+	for _, c := range containers {
+		if c.MountPath != "" && !existing[c.MountPath] {
+			fmt.Fprintln(&b, c.MountPath)
+		}
+	}
+	return os.WriteFile(filepath.Join(filepath.Dir(target), PREVIEW_MOUNTS_FILE), []byte(b.String()), 0644)
+}
+
+// mountPreview mounts the root filesystem a boot of the mounted hostapp root
+// would assemble with the OS blocks of the data partition mounted at data.
+// OS blocks are selected for the hostapp's kernel rather than the running
+// one. The overlay is mounted on the preview directory of the hostapp,
+// replacing any previous preview, and its path is returned.
+func mountPreview(root hostapp.Container, data string) (string, error) {
+	target := previewPath(root.Layers)
+	if err := unmountPreview(target); err != nil && !errors.Is(err, hostapp.ErrNotMounted) {
+		return "", fmt.Errorf("Error unmounting previous preview: %v", err)
+	}
+
+	cmdline := cmdlineOptions{}
+	if content, err := os.ReadFile("/proc/cmdline"); err == nil {
+		cmdline = parseCmdline(string(content))
+	}
+	var containers []hostapp.Container
+	if _, err := os.Stat(filepath.Join(data, PURGE_MARKER_FILE)); cmdline.disableOverlays || err != nil {
+		log.Println("Overlays disabled or purge pending, previewing the hostapp alone")
+	} else {
+		// OS blocks mounted already, as by the running boot, are not the
+		// preview's to unmount
+		mounted, err := hostapp.ReadMountInfo()
+		if err != nil {
+			return "", fmt.Errorf("Error reading mounts: %v", err)
+		}
+		if containers, err = mountExtensions(data); err != nil {
+			return "", err
+		}
+		if err := recordPreviewMounts(target, containers, mounted); err != nil {
+			log.Printf("Warning: recording preview mounts: %v", err)
+		}
+	}
+
+	if len(containers) > 0 {
+		keys, err := hostapp.LoadPublicKeys(SIGNING_KEYS_DIR, filepath.Join(root.MountPath, SIGNING_KEYS_DIR))
+		if err != nil {
+			return "", fmt.Errorf("Error loading signing keys: %v", err)
+		}
+		containers = hostapp.SelectSigned(containers, keys)
+		containers = hostapp.SelectPermitted(containers, &root, cmdline.contentPolicy)
+		containers = hostapp.SelectOSCompatible(containers, &root)
+
+		release, err := root.KernelRelease()
+		if err != nil {
+			return "", fmt.Errorf("Error getting hostapp kernel release: %v", err)
+		}
+		abiID, err := root.ResolveExtensionABIID(release)
+		if err != nil {
+			return "", fmt.Errorf("Error getting hostapp kernel ABI ID: %v", err)
+		}
+		log.Printf("Selecting OS blocks for kernel %s", release)
+		host := hostapp.Host{Platform: root.Platform, DeviceType: runningDeviceType(BOOT_MOUNT_PATH, "")}
+		containers = hostapp.SelectMountable(containers, release, abiID, host)
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return "", fmt.Errorf("Error creating preview directory: %v", err)
+	}
+	mountDir := filepath.Join(data, DATA_LAYER_ROOT, "overlay2")
+	mountPath := func(c hostapp.Container) string { return c.MountPath }
+	left, right, _ := overlayExtensions(root, containers, mountDir, mountPath, cmdline.flatOverlays)
+
+	var lowerDirs []string
+	if cmdline.flatOverlays {
+		var baseLowerDirs []string
+		for _, layer := range root.Layers {
+			baseLowerDirs = append(baseLowerDirs, layer.LowerDir(mountDir))
+		}
+		lowerDirs = hostapp.BuildFlatLowerDirs(baseLowerDirs, left, right, hostapp.OverlayOptionsLimit())
+	} else {
+		lowerDirs = hostapp.BuildOverlayLowerDirs(relativeTo(mountDir, root.MountPath), left, right, hostapp.OverlayOptionsLimit())
+	}
+	if len(lowerDirs) == 1 {
+		// Overlayfs needs two lowerdirs without an upperdir
+		source := lowerDirs[0]
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(mountDir, source)
+		}
+		if err := hostapp.MountReadOnlyBind(source, target); err != nil {
+			return "", fmt.Errorf("Error mounting preview: %v", err)
+		}
+	} else if err := hostapp.MountOverlayFrom(mountDir, target, lowerDirs); err != nil {
+		return "", fmt.Errorf("Error mounting overlay: %v", err)
+	}
+	log.Printf("Mounted preview of %d extensions in %s", len(left)+len(right), target)
+	return target, nil
+}
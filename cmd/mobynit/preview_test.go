@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/balena-os/hostapp"
+)
+
+func TestMountPreview(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to perform overlay mount")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("unshare: %v", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("make mounts private: %v", err)
+	}
+
+	// The new hostapp ships a kernel other than the running one, which the
+	// module-carrying extension is built for
+	options := writePlanFixture(t)
+	hostappDiff := filepath.Join(options.sysroot, HOSTAPP_LAYER_ROOT, "overlay2", "hostapp-layer", "diff")
+	modules := filepath.Join(hostappDiff, "lib", "modules", "6.1.0-test")
+	if err := os.MkdirAll(modules, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(modules, "Module.symvers"), []byte("symbols"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"late", "oldkernel"} {
+		diff := filepath.Join(options.data, DATA_LAYER_ROOT, "overlay2", id+"-layer", "diff")
+		if err := os.WriteFile(filepath.Join(diff, id), []byte(id), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func() {
+		for _, id := range []string{"early", "late", "oldkernel", "modules"} {
+			unix.Unmount(filepath.Join(options.data, DATA_LAYER_ROOT, "overlay2", id+"-layer", "merged"), unix.MNT_DETACH)
+		}
+	}()
+
+	containers, _, err := mountSysroot(options.sysroot, false)
+	if err != nil {
+		t.Fatalf("mountSysroot: %v", err)
+	}
+	root := containers[0]
+	defer unix.Unmount(root.MountPath, unix.MNT_DETACH)
+	target, err := mountPreview(root, options.data)
+	if err != nil {
+		t.Fatalf("mountPreview: %v", err)
+	}
+	defer unix.Unmount(target, unix.MNT_DETACH)
+	if target != previewPath(root.Layers) {
+		t.Errorf("expected the preview in %s, got %s", previewPath(root.Layers), target)
+	}
+
+	for _, path := range []string{"etc/issue", "late", "usr/lib/modules/6.1.0-test/Module.symvers"} {
+		if _, err := os.Stat(filepath.Join(target, path)); err != nil {
+			t.Errorf("expected %s in the preview: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(target, "oldkernel")); err == nil {
+		t.Errorf("expected the OS block for another kernel to be left out")
+	}
+	if _, err := os.Stat(filepath.Join(root.MountPath, "late")); err == nil {
+		t.Errorf("expected the hostapp mount to be left as is")
+	}
+
+	// A retry replaces the preview rather than stacking another
+	if _, err := mountPreview(root, options.data); err != nil {
+		t.Fatalf("mountPreview again: %v", err)
+	}
+	if code := unmountSysroot(options.sysroot); code != 0 {
+		t.Errorf("expected unmounting to succeed, got exit code %d", code)
+	}
+	if err := hostapp.Unmount(target); !errors.Is(err, hostapp.ErrNotMounted) {
+		t.Errorf("expected the preview to be unmounted, got %v", err)
+	}
+	// The OS block mounts the preview made go with it
+	for _, id := range []string{"early", "late", "modules"} {
+		merged := filepath.Join(options.data, DATA_LAYER_ROOT, "overlay2", id+"-layer", "merged")
+		if err := hostapp.Unmount(merged); !errors.Is(err, hostapp.ErrNotMounted) {
+			t.Errorf("expected OS block %s to be unmounted, got %v", id, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(target), PREVIEW_MOUNTS_FILE)); !os.IsNotExist(err) {
+		t.Errorf("expected the preview mounts record to be removed, got %v", err)
+	}
+}
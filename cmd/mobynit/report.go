@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/balena-os/hostapp"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	REPORT_DIR  = "/run/mobynit"
+	REPORT_FILE = "boot.json"
+)
+
+// bootReport describes how the root filesystem was assembled, for tooling
+// that would otherwise have to scrape the initramfs log
+type bootReport struct {
+	Hostapp           *reportContainer   `json:"hostapp,omitempty"`
+	HostappCandidates []reportHostapp    `json:"hostapp_candidates"`
+	Extensions        []*reportContainer `json:"extensions"`
+	FlatOverlay       bool               `json:"flat_overlay"`
+	KernelABIID       string             `json:"kernel_abi_id,omitempty"`
+	KernelABISource   string             `json:"kernel_abi_source,omitempty"`
+	Phases            []reportPhase      `json:"phases"`
+	extensionsByID    map[string]*reportContainer
+}
+
+// reportHostapp is a hostapp considered for boot, in preference order
+type reportHostapp struct {
+	Source string `json:"source"`
+	ID     string `json:"id"`
+	Error  string `json:"error,omitempty"`
+}
+
+// reportContainer is the hostapp or an OS block. Position is its index in
+// the overlay stack, highest precedence first, if it is part of it.
+type reportContainer struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Kept       bool              `json:"kept"`
+	DropReason string            `json:"drop_reason,omitempty"`
+	Position   *int              `json:"position,omitempty"`
+}
+
+// reportPhase is the time spent in one step of the boot
+type reportPhase struct {
+	Name       string  `json:"name"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+var report = &bootReport{}
+
+// phase starts timing the named phase; the returned function ends it
+func (r *bootReport) phase(name string) func() {
+	start := time.Now()
+	return func() {
+		r.Phases = append(r.Phases, reportPhase{
+			Name:       name,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		})
+	}
+}
+
+func newReportContainer(c hostapp.Container) *reportContainer {
+	return &reportContainer{ID: c.ID, Name: c.Name, Labels: c.Labels}
+}
+
+// setHostapp records the hostapp candidates and the one booted, if any
+func (r *bootReport) setHostapp(containers []hostapp.Container, candidates []hostappCandidate) {
+	r.HostappCandidates = nil
+	for _, candidate := range candidates {
+		entry := reportHostapp{Source: candidate.Source, ID: candidate.ID}
+		if candidate.Err != nil {
+			entry.Error = candidate.Err.Error()
+		}
+		r.HostappCandidates = append(r.HostappCandidates, entry)
+	}
+	if len(containers) == 1 {
+		r.Hostapp = newReportContainer(containers[0])
+		r.Hostapp.Kept = true
+	}
+}
+
+func (r *bootReport) extension(c hostapp.Container) *reportContainer {
+	if r.extensionsByID == nil {
+		r.extensionsByID = make(map[string]*reportContainer)
+	}
+	entry, ok := r.extensionsByID[c.ID]
+	if !ok {
+		entry = newReportContainer(c)
+		r.extensionsByID[c.ID] = entry
+		r.Extensions = append(r.Extensions, entry)
+	}
+	return entry
+}
+
+// addExtensions records mounted OS blocks as kept until they are dropped
+func (r *bootReport) addExtensions(containers []hostapp.Container) {
+	for _, c := range containers {
+		r.extension(c).Kept = true
+	}
+}
+
+// dropped records why an OS block was left out. It is set as
+// hostapp.Dropped.
+func (r *bootReport) dropped(c hostapp.Container, reason string) {
+	entry := r.extension(c)
+	entry.Kept = false
+	entry.DropReason = reason
+}
+
+// placeExtensions records the overlay stack positions of the extensions in
+// lowerDirs, as returned by hostapp.BuildOverlayLowerDirs or
+// BuildFlatLowerDirs, given the extension IDs by mount path. Extensions
+// left out of lowerDirs did not fit the mount options, or required one that
+// did not.
+func (r *bootReport) placeExtensions(lowerDirs []string, left, right []hostapp.Extension, ids map[string]string) {
+	stacked := make(map[string]bool, len(lowerDirs))
+	for _, dir := range lowerDirs {
+		stacked[dir] = true
+	}
+	firstDir := func(e hostapp.Extension) string {
+		if len(e.LowerDirs) > 0 {
+			return e.LowerDirs[0]
+		}
+		return e.MountPath
+	}
+	fit := make(map[string]bool, len(left)+len(right))
+	for _, e := range append(append([]hostapp.Extension{}, left...), right...) {
+		fit[hostapp.ExtensionName(e.Name)] = stacked[firstDir(e)]
+	}
+	position := 0
+	place := func(e hostapp.Extension) {
+		entry, ok := r.extensionsByID[ids[e.MountPath]]
+		if !ok {
+			return
+		}
+		if !stacked[firstDir(e)] {
+			entry.Kept = false
+			entry.DropReason = "page size limit"
+			for _, name := range e.Requires {
+				if stackedDep, known := fit[name]; known && !stackedDep {
+					entry.DropReason = fmt.Sprintf("requires %q, dropped due to page size limit", name)
+					break
+				}
+			}
+			return
+		}
+		p := position
+		entry.Position = &p
+		position++
+	}
+	for _, e := range left {
+		place(e)
+	}
+	if r.Hostapp != nil {
+		p := position
+		r.Hostapp.Position = &p
+	}
+	position++
+	for _, e := range right {
+		place(e)
+	}
+}
+
+// reportDir returns where the report goes for it to be found in the new
+// root's /run. That is the initramfs /run when it is a mount, as it is moved
+// into the new root. Otherwise a tmpfs is mounted on the new root's /run,
+// which systemd keeps as it finds it mounted.
+func reportDir(newRoot string, mounts []hostapp.MountEntry) (string, error) {
+	for _, m := range mounts {
+		if m.MountPoint == "/run" {
+			return REPORT_DIR, nil
+		}
+	}
+	if err := unix.Mount("tmpfs", filepath.Join(newRoot, "run"), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755"); err != nil {
+		return "", fmt.Errorf("Error mounting /run: %v", err)
+	}
+	return filepath.Join(newRoot, REPORT_DIR), nil
+}
+
+// write stores the report as REPORT_FILE in dir
+func (r *bootReport) write(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Error creating %s: %v", dir, err)
+	}
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding boot report: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, REPORT_FILE), content, 0644); err != nil {
+		return fmt.Errorf("Error writing boot report: %v", err)
+	}
+	return nil
+}
+
+// bootedHostapp returns the ID of the hostapp recorded in the boot report in
+// dir, or "" if there is no readable report
+func bootedHostapp(dir string) string {
+	content, err := os.ReadFile(filepath.Join(dir, REPORT_FILE))
+	if err != nil {
+		return ""
+	}
+	var r bootReport
+	if err := json.Unmarshal(content, &r); err != nil || r.Hostapp == nil {
+		return ""
+	}
+	return r.Hostapp.ID
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/balena-os/hostapp"
+)
+
+func TestBootReport(t *testing.T) {
+	r := &bootReport{}
+	ext := func(id string, labels map[string]string) hostapp.Container {
+		return hostapp.Container{Config: hostapp.Config{ID: id, Name: id, HostConfig: hostapp.HostConfig{Labels: labels}}}
+	}
+
+	r.setHostapp(
+		[]hostapp.Container{{Config: hostapp.Config{ID: "current", Name: "hostapp"}}},
+		[]hostappCandidate{{Source: NEXT_LINK, ID: "next", Err: errors.New("broken")}, {Source: CURRENT_LINK, ID: "current"}},
+	)
+	r.dropped(ext("unmountable", nil), "reading mount-id: no such file")
+	r.addExtensions([]hostapp.Container{
+		ext("early", map[string]string{hostapp.HOSTOS_BLOCKS_OVERRIDE: "1"}),
+		ext("right", nil),
+		ext("big", nil),
+		ext("plugin", nil),
+		ext("mismatch", nil),
+	})
+	r.dropped(ext("mismatch", nil), "kernel version mismatch")
+
+	left := []hostapp.Extension{{Name: "early", MountPath: "early/merged", Priority: 1}}
+	right := []hostapp.Extension{
+		{Name: "right", MountPath: "right/merged"},
+		{Name: "big", MountPath: "big/merged"},
+		{Name: "plugin", MountPath: "plugin/merged", Requires: []string{"big"}},
+	}
+	ids := map[string]string{"early/merged": "early", "right/merged": "right", "big/merged": "big", "plugin/merged": "plugin"}
+	r.placeExtensions([]string{"early/merged", "hostapp/merged", "right/merged"}, left, right, ids)
+	r.phase("mount_overlay")()
+
+	dir := filepath.Join(t.TempDir(), "run", "mobynit")
+	if err := r.write(dir); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, REPORT_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Hostapp struct {
+			ID       string
+			Position *int
+		}
+		HostappCandidates []struct {
+			Source string
+			ID     string
+			Error  string
+		} `json:"hostapp_candidates"`
+		Extensions []struct {
+			ID         string
+			Kept       bool
+			DropReason string `json:"drop_reason"`
+			Position   *int
+		}
+		Phases []struct{ Name string }
+	}
+	if err := json.Unmarshal(content, &got); err != nil {
+		t.Fatalf("decoding report: %v", err)
+	}
+
+	if got.Hostapp.ID != "current" || got.Hostapp.Position == nil || *got.Hostapp.Position != 1 {
+		t.Errorf("unexpected hostapp %+v", got.Hostapp)
+	}
+	if len(got.HostappCandidates) != 2 || got.HostappCandidates[0].Error != "broken" || got.HostappCandidates[1].Error != "" {
+		t.Errorf("unexpected hostapp candidates %+v", got.HostappCandidates)
+	}
+
+	type want struct {
+		kept     bool
+		reason   string
+		position int
+	}
+	wants := map[string]want{
+		"unmountable": {false, "reading mount-id: no such file", -1},
+		"early":       {true, "", 0},
+		"right":       {true, "", 2},
+		"big":         {false, "page size limit", -1},
+		"plugin":      {false, `requires "big", dropped due to page size limit`, -1},
+		"mismatch":    {false, "kernel version mismatch", -1},
+	}
+	if len(got.Extensions) != len(wants) {
+		t.Fatalf("expected %d extensions, got %+v", len(wants), got.Extensions)
+	}
+	for _, e := range got.Extensions {
+		w := wants[e.ID]
+		position := -1
+		if e.Position != nil {
+			position = *e.Position
+		}
+		if e.Kept != w.kept || e.DropReason != w.reason || position != w.position {
+			t.Errorf("extension %s: expected %+v, got kept=%v reason=%q position=%d", e.ID, w, e.Kept, e.DropReason, position)
+		}
+	}
+	if len(got.Phases) != 1 || got.Phases[0].Name != "mount_overlay" {
+		t.Errorf("unexpected phases %+v", got.Phases)
+	}
+}
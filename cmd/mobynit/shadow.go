@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/balena-os/hostapp"
+)
+
+// runShadow implements the shadow subcommand: it prints the paths where an
+// image of the overlay stack a boot would build hides another's copy
+func runShadow(w io.Writer, args []string) error {
+	options, asJSON, err := parsePlanOptions("shadow", args)
+	if err != nil {
+		return err
+	}
+	shadows, err := shadow(options)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		if shadows == nil {
+			shadows = []hostapp.Shadow{}
+		}
+		content, err := json.MarshalIndent(shadows, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(content))
+		return err
+	}
+	printShadows(w, shadows)
+	return nil
+}
+
+// shadow plans a boot and reports the shadowing in its overlay stack
+func shadow(options planOptions) ([]hostapp.Shadow, error) {
+	r, _, err := plan(options)
+	if err != nil {
+		return nil, err
+	}
+	stack, err := planStack(options, r)
+	if err != nil {
+		return nil, err
+	}
+	return hostapp.ShadowReport(stack, r.FlatOverlay)
+}
+
+// planStack returns the images of the overlay stack recorded in r by plan,
+// highest precedence first. In a flat overlay OS blocks only contribute
+// the layers they do not share with the hostapp.
+func planStack(options planOptions, r *bootReport) ([]hostapp.StackImage, error) {
+	root, err := hostapp.FindID(filepath.Join(options.sysroot, HOSTAPP_LAYER_ROOT), r.Hostapp.ID)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := findExtensions(options.data)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]hostapp.Container, len(containers))
+	for _, c := range containers {
+		byID[c.ID] = c
+	}
+
+	type placed struct {
+		position int
+		image    hostapp.StackImage
+	}
+	stack := []placed{{*r.Hostapp.Position, hostapp.StackImage{Name: root.Name, Layers: root.Layers}}}
+	for _, e := range r.Extensions {
+		c, ok := byID[e.ID]
+		if e.Position == nil || !ok {
+			continue
+		}
+		layers := c.Layers
+		if r.FlatOverlay {
+			layers = c.OwnLayers(&root)
+		}
+		stack = append(stack, placed{*e.Position, hostapp.StackImage{Name: c.Name, Layers: layers}})
+	}
+	sort.Slice(stack, func(i, j int) bool { return stack[i].position < stack[j].position })
+
+	images := make([]hostapp.StackImage, len(stack))
+	for i, p := range stack {
+		images[i] = p.image
+	}
+	return images, nil
+}
+
+// printShadows prints a line per shadowed path
+func printShadows(w io.Writer, shadows []hostapp.Shadow) {
+	if len(shadows) == 0 {
+		fmt.Fprintln(w, "No image of the overlay stack shadows another")
+		return
+	}
+	for _, s := range shadows {
+		verb := "overrides"
+		switch {
+		case s.Whiteout:
+			verb = "deletes"
+		case s.Opaque:
+			verb = "replaces (opaque)"
+		}
+		var shadowed []string
+		for _, l := range s.Shadows {
+			shadowed = append(shadowed, fmt.Sprintf("%s (%s)", l.Image, shortID(l.Layer)))
+		}
+		fmt.Fprintf(w, "%s: %s (%s) %s %s\n", s.Path, s.Provider.Image, shortID(s.Provider.Layer), verb, strings.Join(shadowed, ", "))
+	}
+}
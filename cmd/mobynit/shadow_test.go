@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/balena-os/hostapp"
+)
+
+func TestShadow(t *testing.T) {
+	options := writePlanFixture(t)
+	writeLayeredContainer(t, filepath.Join(options.data, DATA_LAYER_ROOT), "issue",
+		map[string]string{HOSTOS_BLOCKS_CLASS: "overlay", hostapp.HOSTOS_BLOCKS_OVERRIDE: "2"},
+		map[string]string{"etc/issue": "custom", "etc/motd": "hello"})
+
+	shadows, err := shadow(options)
+	if err != nil {
+		t.Fatalf("shadow: %v", err)
+	}
+	if len(shadows) != 1 {
+		t.Fatalf("expected one shadowed path, got %+v", shadows)
+	}
+	s := shadows[0]
+	if s.Path != "/etc/issue" || s.Provider.Image != "issue" || len(s.Shadows) != 1 || s.Shadows[0].Image != "hostapp" {
+		t.Errorf("unexpected shadow %+v", s)
+	}
+
+	var out bytes.Buffer
+	printShadows(&out, shadows)
+	want := fmt.Sprintf("/etc/issue: issue (%s) overrides hostapp (%s)", shortID("issue-layer"), shortID("hostapp-layer"))
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("expected %q in output:\n%s", want, out.String())
+	}
+}
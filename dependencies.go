@@ -0,0 +1,179 @@
+package hostapp
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	HOSTOS_BLOCKS_REQUIRES  = "io.balena.image.requires"
+	HOSTOS_BLOCKS_CONFLICTS = "io.balena.image.conflicts"
+)
+
+// ExtensionName is the name requires and conflicts labels refer to an OS
+// block by, given its container or Extension name: the container name
+// without docker's leading slash, or the image reference of an image
+func ExtensionName(name string) string {
+	return strings.TrimPrefix(name, "/")
+}
+
+// labelNames returns the comma separated extension names of a label
+func labelNames(c Container, label string) []string {
+	var names []string
+	for _, name := range strings.Split(c.Labels[label], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Requires returns the names of the OS blocks c requires, from its requires
+// label
+func (c *Container) Requires() []string {
+	return labelNames(*c, HOSTOS_BLOCKS_REQUIRES)
+}
+
+// ResolveDependencies drops the OS blocks whose requires and conflicts
+// labels cannot be satisfied among containers, and returns the rest with
+// each one after those it requires, in the order given otherwise. In turn:
+//
+//   - the members of a cycle of requirements are dropped
+//   - an OS block is dropped when one it requires is missing or dropped
+//   - of two conflicting OS blocks, a required one (see IsRequired) is kept
+//     over one that is not, and otherwise the one whose name sorts first.
+//     Either side of the pair may declare the conflict.
+func ResolveDependencies(containers []Container) []Container {
+	byName := make(map[string]int, len(containers))
+	for i := range containers {
+		if _, ok := byName[ExtensionName(containers[i].Name)]; !ok {
+			byName[ExtensionName(containers[i].Name)] = i
+		}
+	}
+	dropped := make(map[int]bool)
+	drop := func(i int, reason string, isError bool) {
+		if dropped[i] {
+			return
+		}
+		dropped[i] = true
+		if isError {
+			log.Printf("Error: dropping container %s: %s", containers[i].Name, reason)
+		} else {
+			log.Printf("Skipping container %s: %s", containers[i].Name, reason)
+		}
+		reportDropped(containers[i], reason)
+	}
+
+	// Order requirements first, dropping cycles as they are found
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(containers))
+	var order, stack []int
+	var visit func(i int)
+	visit = func(i int) {
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, name := range labelNames(containers[i], HOSTOS_BLOCKS_REQUIRES) {
+			j, ok := byName[name]
+			if !ok {
+				continue
+			}
+			switch state[j] {
+			case unvisited:
+				visit(j)
+			case visiting:
+				start := len(stack) - 1
+				for stack[start] != j {
+					start--
+				}
+				var names []string
+				for _, k := range stack[start:] {
+					names = append(names, ExtensionName(containers[k].Name))
+				}
+				reason := "dependency cycle " + strings.Join(append(names, name), " -> ")
+				for _, k := range stack[start:] {
+					drop(k, reason, true)
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = visited
+		order = append(order, i)
+	}
+	for i := range containers {
+		if state[i] == unvisited {
+			visit(i)
+		}
+	}
+
+	// With requirements ordered first, one pass drops dependents transitively
+	dropDependents := func() {
+		for _, i := range order {
+			if dropped[i] {
+				continue
+			}
+			for _, name := range labelNames(containers[i], HOSTOS_BLOCKS_REQUIRES) {
+				if j, ok := byName[name]; !ok {
+					drop(i, fmt.Sprintf("requires %q, which is not available", name), false)
+					break
+				} else if dropped[j] {
+					drop(i, fmt.Sprintf("requires %q, which was dropped", name), false)
+					break
+				}
+			}
+		}
+	}
+	dropDependents()
+
+	byPrecedence := make([]int, len(containers))
+	for i := range byPrecedence {
+		byPrecedence[i] = i
+	}
+	// Conflicts are settled by precedence: required first, then by name
+	sort.SliceStable(byPrecedence, func(a, b int) bool {
+		ca, cb := &containers[byPrecedence[a]], &containers[byPrecedence[b]]
+		if ca.IsRequired() != cb.IsRequired() {
+			return ca.IsRequired()
+		}
+		return ExtensionName(ca.Name) < ExtensionName(cb.Name)
+	})
+	conflicts := make(map[int]map[int]bool)
+	for i := range containers {
+		for _, name := range labelNames(containers[i], HOSTOS_BLOCKS_CONFLICTS) {
+			if j, ok := byName[name]; ok && j != i {
+				for _, pair := range [][2]int{{i, j}, {j, i}} {
+					if conflicts[pair[0]] == nil {
+						conflicts[pair[0]] = make(map[int]bool)
+					}
+					conflicts[pair[0]][pair[1]] = true
+				}
+			}
+		}
+	}
+	// Going by precedence, each OS block still kept drops those it conflicts
+	// with further down
+	for r, i := range byPrecedence {
+		if dropped[i] {
+			continue
+		}
+		for _, j := range byPrecedence[r+1:] {
+			if conflicts[i][j] && !dropped[j] {
+				drop(j, fmt.Sprintf("conflicts with %q", ExtensionName(containers[i].Name)), false)
+				dropDependents()
+			}
+		}
+	}
+
+	var resolved []Container
+	for _, i := range order {
+		if !dropped[i] {
+			resolved = append(resolved, containers[i])
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,117 @@
+package hostapp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveDependencies(t *testing.T) {
+	block := func(name, requires, conflicts string) Container {
+		labels := map[string]string{}
+		if requires != "" {
+			labels[HOSTOS_BLOCKS_REQUIRES] = requires
+		}
+		if conflicts != "" {
+			labels[HOSTOS_BLOCKS_CONFLICTS] = conflicts
+		}
+		return makeTestContainer("/"+name, labels)
+	}
+	tests := []struct {
+		name       string
+		containers []Container
+		expect     []string
+		reasons    map[string]string
+	}{
+		{
+			name: "requirements are ordered first",
+			containers: []Container{
+				block("tools", "driver, firmware", ""),
+				block("firmware", "", ""),
+				block("driver", "firmware", ""),
+				block("other", "", ""),
+			},
+			expect: []string{"firmware", "driver", "tools", "other"},
+		},
+		{
+			name: "dependents of missing blocks are dropped transitively",
+			containers: []Container{
+				block("tools", "driver", ""),
+				block("driver", "firmware", ""),
+				block("other", "", ""),
+			},
+			expect: []string{"other"},
+			reasons: map[string]string{
+				"driver": `requires "firmware", which is not available`,
+				"tools":  `requires "driver", which was dropped`,
+			},
+		},
+		{
+			name: "cycles are dropped",
+			containers: []Container{
+				block("a", "b", ""),
+				block("b", "c", ""),
+				block("c", "a", ""),
+				block("d", "c", ""),
+				block("e", "", ""),
+			},
+			expect: []string{"e"},
+			reasons: map[string]string{
+				"a": "dependency cycle a -> b -> c -> a",
+				"b": "dependency cycle a -> b -> c -> a",
+				"c": "dependency cycle a -> b -> c -> a",
+				"d": `requires "c", which was dropped`,
+			},
+		},
+		{
+			name: "the first name wins a conflict, declared by either side",
+			containers: []Container{
+				block("zeta", "", ""),
+				block("alpha", "", "zeta"),
+				block("tools", "zeta", ""),
+			},
+			expect: []string{"alpha"},
+			reasons: map[string]string{
+				"zeta":  `conflicts with "alpha"`,
+				"tools": `requires "zeta", which was dropped`,
+			},
+		},
+		{
+			name: "a required block wins a conflict",
+			containers: []Container{
+				block("alpha", "", "zeta"),
+				makeTestContainer("/zeta", map[string]string{HOSTOS_BLOCKS_REQUIRED: "true"}),
+			},
+			expect:  []string{"zeta"},
+			reasons: map[string]string{"alpha": `conflicts with "zeta"`},
+		},
+		{
+			name: "a dropped block no longer conflicts",
+			containers: []Container{
+				block("alpha", "", "beta"),
+				block("beta", "", "gamma"),
+				block("gamma", "", ""),
+			},
+			expect: []string{"alpha", "gamma"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reasons := map[string]string{}
+			Dropped = func(c Container, reason string) { reasons[ExtensionName(c.Name)] = reason }
+			defer func() { Dropped = nil }()
+
+			var got []string
+			for _, c := range ResolveDependencies(tt.containers) {
+				got = append(got, ExtensionName(c.Name))
+			}
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("expected %v, got %v", tt.expect, got)
+			}
+			for name, reason := range tt.reasons {
+				if reasons[name] != reason {
+					t.Errorf("expected %s to be dropped for %q, got %q", name, reason, reasons[name])
+				}
+			}
+		})
+	}
+}
@@ -2,4 +2,7 @@ module github.com/balena-os/hostapp
 
 go 1.22
 
-require golang.org/x/sys v0.16.0
+require (
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/sys v0.16.0
+)
@@ -4,12 +4,15 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"golang.org/x/sys/unix"
@@ -38,6 +41,16 @@ type Container struct {
 	Config
 	MountPath string
 	HomePath  string
+	// Layers is the layer chain resolved when the container was mounted,
+	// top layer first
+	Layers []Layer
+	// Platform is the platform of the container's image, when known
+	Platform Platform
+	// layerID is the container's own layer, for storage layouts that record
+	// it alongside the container
+	layerID string
+	// layerRoot is the storage root Layers were resolved from
+	layerRoot string
 }
 
 var (
@@ -45,45 +58,165 @@ var (
 	Debug bool = false
 	// Verbose enables verbose logging
 	Verbose bool = false
+	// VerifyLayers checks overlay2 layers against their layerdb digests
+	// before mounting or resolving them
+	VerifyLayers bool = false
+	// Dropped, when set, is told about each container that Mount or Find
+	// fails to mount or resolve, or that a filter leaves out, and why. Like
+	// the options above it is package state and not safe for concurrent use:
+	// set it from the goroutine making the calls it should hear about, and
+	// reset it once they return.
+	Dropped func(c Container, reason string)
 )
 
-// mount mounts the container's overlay filesystem using direct overlay2 metadata reading
-func (container *Container) mount(layerRoot string) (string, error) {
-	if container.Driver != "overlay2" {
-		return "", fmt.Errorf("unsupported driver %s for container %s", container.Driver, container.Name)
+// reportDropped passes a dropped container to Dropped
+func reportDropped(c Container, reason string) {
+	if Dropped != nil {
+		Dropped(c, reason)
+	}
+}
+
+// Layer is one overlay2 layer of a container's layer chain
+type Layer struct {
+	// ID is the layer's directory name under overlay2/
+	ID string
+	// Link is the layer's short link relative to overlay2/ ("l/<shortid>"),
+	// or the absolute DiffPath for layers without one
+	Link string
+	// DiffPath is the absolute path of the layer's diff directory
+	DiffPath string
+	// ChainID is the layerdb chain ID of an image layer, which identifies
+	// the layer together with every layer below it across storage roots.
+	// It is empty for a container's own read-write layer.
+	ChainID string
+}
+
+// layerChainIDs maps the overlay2 directory (cache-id) of every image layer
+// in layerRoot's layerdb to its chain ID
+func layerChainIDs(layerRoot string) (map[string]string, error) {
+	layerdbDir := filepath.Join(layerRoot, "image", "overlay2", "layerdb", "sha256")
+	entries, err := os.ReadDir(layerdbDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading layerdb: %w", err)
+	}
+	chainIDs := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		cacheID, err := os.ReadFile(filepath.Join(layerdbDir, entry.Name(), "cache-id"))
+		if err != nil {
+			continue
+		}
+		chainIDs[strings.TrimSpace(string(cacheID))] = "sha256:" + entry.Name()
+	}
+	return chainIDs, nil
+}
+
+// LowerDir names the layer as a lowerdir of an overlay mounted from dir (see
+// MountOverlayFrom): its short link when dir is the layer's own overlay2
+// directory, otherwise the shorter of the absolute and dir-relative paths.
+func (layer Layer) LowerDir(dir string) string {
+	if !filepath.IsAbs(layer.Link) {
+		overlay2Dir := filepath.Dir(filepath.Dir(layer.DiffPath))
+		if overlay2Dir == filepath.Clean(dir) {
+			return layer.Link
+		}
+		abs := filepath.Join(overlay2Dir, layer.Link)
+		if rel, err := filepath.Rel(dir, abs); err == nil && len(rel) < len(abs) {
+			return rel
+		}
+		return abs
+	}
+	if rel, err := filepath.Rel(dir, layer.DiffPath); err == nil && len(rel) < len(layer.DiffPath) {
+		return rel
+	}
+	return layer.DiffPath
+}
+
+// layers resolves the container's layer chain, top layer first, with the
+// reader for its storage driver. It also returns the directory of the
+// container's own layer: the overlay is mounted on its merged subdirectory,
+// from its parent directory.
+func (container *Container) layers(layerRoot string) (string, []Layer, error) {
+	switch container.Driver {
+	case "overlay2":
+		return container.overlay2Layers(layerRoot)
+	case "overlayfs":
+		return container.containerdLayers(layerRoot)
+	case "overlay":
+		return container.containersStorageLayers(layerRoot)
+	}
+	return "", nil, fmt.Errorf("unsupported driver %s for container %s", container.Driver, container.Name)
+}
+
+// overlay2Layers resolves the container's overlay2 layer chain, top layer
+// first, from the layerdb mount-id, or from the top layer of an image.
+// Layers are annotated with their layerdb chain IDs.
+func (container *Container) overlay2Layers(layerRoot string) (string, []Layer, error) {
+	// Images record their top layer; containers have a mount-id in layerdb
+	mountID := container.layerID
+	if mountID == "" {
+		mountIDPath := filepath.Join(layerRoot, "image", "overlay2", "layerdb", "mounts", container.ID, "mount-id")
+		mountIDBytes, err := os.ReadFile(mountIDPath)
+		if err != nil {
+			return "", nil, fmt.Errorf("reading mount-id: %w", err)
+		}
+		mountID = strings.TrimSpace(string(mountIDBytes))
+	}
+
+	chainIDs, err := layerChainIDs(layerRoot)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// Get mount-id from layerdb
-	mountIDPath := filepath.Join(layerRoot, "image", "overlay2", "layerdb", "mounts", container.ID, "mount-id")
-	mountIDBytes, err := os.ReadFile(mountIDPath)
+	layerDir, layers, err := overlayLayers(filepath.Join(layerRoot, "overlay2"), mountID)
 	if err != nil {
-		return "", fmt.Errorf("reading mount-id: %w", err)
+		return "", nil, err
+	}
+	for i := range layers {
+		layers[i].ChainID = chainIDs[layers[i].ID]
 	}
-	mountID := strings.TrimSpace(string(mountIDBytes))
+	return layerDir, layers, nil
+}
 
-	overlay2Dir := filepath.Join(layerRoot, "overlay2")
-	layerDir := filepath.Join(overlay2Dir, mountID)
+// overlayLayers resolves the layer chain of the layer topID in overlayDir,
+// top layer first, from the layer's link and lower files. This layout is
+// shared by Docker's overlay2 graph driver and containers/storage's overlay
+// driver. Init layers are left out.
+func overlayLayers(overlayDir string, topID string) (string, []Layer, error) {
+	overlayDir, err := filepath.Abs(overlayDir)
+	if err != nil {
+		return "", nil, err
+	}
+	layerDir := filepath.Join(overlayDir, topID)
 
-	// The layer's own diff directory - this is the top layer
-	diffDir := filepath.Join(layerDir, "diff")
+	// The layer's own diff directory - this is the top layer. It is referred
+	// to by its short link when it has one.
+	top := Layer{ID: topID, DiffPath: filepath.Join(layerDir, "diff")}
+	top.Link = top.DiffPath
+	if linkBytes, err := os.ReadFile(filepath.Join(layerDir, "link")); err == nil {
+		top.Link = filepath.Join("l", strings.TrimSpace(string(linkBytes)))
+	} else if !os.IsNotExist(err) {
+		return "", nil, fmt.Errorf("reading link file: %w", err)
+	}
 
 	// Read lower file to get parent layer chain
 	lowerPath := filepath.Join(layerDir, "lower")
 	lowerBytes, err := os.ReadFile(lowerPath)
 	if err != nil && !os.IsNotExist(err) {
-		return "", fmt.Errorf("reading lower file: %w", err)
+		return "", nil, fmt.Errorf("reading lower file: %w", err)
 	}
 
-	// Build lowerdir list: diff first, then all parent layers (including init)
 	// For readonly overlay, diff is part of lowerdir (no upperdir)
-	lowerDirs := []string{diffDir}
+	layers := []Layer{top}
 
 	if len(lowerBytes) > 0 {
 		links := strings.Split(strings.TrimSpace(string(lowerBytes)), ":")
 		for _, link := range links {
-			resolved, err := filepath.EvalSymlinks(filepath.Join(overlay2Dir, link))
+			resolved, err := filepath.EvalSymlinks(filepath.Join(overlayDir, link))
 			if err != nil {
-				return "", fmt.Errorf("resolving %s: %w", link, err)
+				return "", nil, fmt.Errorf("resolving %s: %w", link, err)
 			}
 			// Skip init layers - they contain .dockerenv which causes
 			// systemd to detect container mode
@@ -93,27 +226,130 @@ func (container *Container) mount(layerRoot string) (string, error) {
 				}
 				continue
 			}
-			lowerDirs = append(lowerDirs, resolved)
+			layers = append(layers, Layer{
+				ID:       filepath.Base(filepath.Dir(resolved)),
+				Link:     link,
+				DiffPath: resolved,
+			})
+		}
+	}
+
+	return layerDir, layers, nil
+}
+
+// OwnLayers returns the top of the container's layer chain down to, but not
+// including, the first layer it shares with base's chain. Extensions built
+// FROM the hostapp image repeat the hostapp's layers; those are already in
+// the hostapp and need not be stacked again. Layers are shared when they have
+// the same diff directory or the same chain ID, and since a chain ID covers
+// every layer below it, so are all the layers beneath a shared one.
+func (container *Container) OwnLayers(base *Container) []Layer {
+	diffPaths := make(map[string]bool, len(base.Layers))
+	chainIDs := make(map[string]bool, len(base.Layers))
+	for _, layer := range base.Layers {
+		diffPaths[layer.DiffPath] = true
+		if layer.ChainID != "" {
+			chainIDs[layer.ChainID] = true
+		}
+	}
+	for i, layer := range container.Layers {
+		if diffPaths[layer.DiffPath] || (layer.ChainID != "" && chainIDs[layer.ChainID]) {
+			if Debug {
+				log.Printf("Container %s shares %d layers with %s", container.Name, len(container.Layers)-i, base.Name)
+			}
+			return container.Layers[:i]
 		}
 	}
+	return container.Layers
+}
 
-	// Mount point: overlay2/<mount-id>/merged
+// HasDeletions reports whether any of layers holds a whiteout or an opaque
+// directory. Layers without either show the same files wherever they are
+// stacked, so they can be overlaid without the rest of their chain.
+func HasDeletions(layers []Layer) (bool, error) {
+	found := false
+	for _, layer := range layers {
+		err := filepath.WalkDir(layer.DiffPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type()&fs.ModeCharDevice != 0 {
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				found = isWhiteout(fi)
+			}
+			if found || strings.HasPrefix(d.Name(), whiteoutPrefix) || (d.IsDir() && isOpaque(path)) {
+				found = true
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			return false, fmt.Errorf("walking layer %s: %w", layer.ID, err)
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mount mounts the container's overlay filesystem using direct overlay2 metadata reading
+func (container *Container) mount(layerRoot string) (string, error) {
+	layerDir, layers, err := container.layers(layerRoot)
+	if err != nil {
+		return "", err
+	}
+	if VerifyLayers {
+		if err := container.verifyLayers(layerRoot, layers); err != nil {
+			return "", err
+		}
+	}
+
+	// Build lowerdir list: diff first, then all parent layers. Layers are
+	// named by their short links, relative to the storage directory the
+	// overlay is mounted from, as dockerd does, to keep the options short.
+	storageDir := filepath.Dir(layerDir)
+	lowerDirs := make([]string, 0, len(layers))
+	for _, layer := range layers {
+		lowerDirs = append(lowerDirs, layer.LowerDir(storageDir))
+	}
+
+	// Mount point: e.g. overlay2/<mount-id>/merged
 	mountPoint := filepath.Join(layerDir, "merged")
 	if err := os.MkdirAll(mountPoint, 0755); err != nil {
 		return "", fmt.Errorf("creating mount point: %w", err)
 	}
 
-	// Build overlay options (readonly - no upperdir/workdir)
-	opts := "lowerdir=" + strings.Join(lowerDirs, ":")
-	if len(opts) >= os.Getpagesize()-1 {
-		return "", fmt.Errorf("mount options (%d bytes) exceed page size limit", len(opts))
+	// A previous run may have mounted the container already
+	existing, err := mountedAt(mountPoint)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		if !existing.mountsLayers(mountPoint, storageDir, layers) {
+			return "", fmt.Errorf("%s: %w by %s mount of %s", mountPoint, ErrMountConflict, existing.FSType, existing.Source)
+		}
+		container.MountPath = mountPoint
+		container.Layers, container.layerRoot = layers, layerRoot
+		log.Printf("ID %s already mounted in %s\n", container.ID, container.MountPath)
+		return container.MountPath, nil
 	}
 
-	if err := unix.Mount("overlay", mountPoint, "overlay", 0, opts); err != nil {
-		return "", fmt.Errorf("mounting overlay: %w", err)
+	// Readonly overlay - no upperdir/workdir. Overlayfs needs two lowerdirs
+	// without an upperdir, so a single layer image is bind mounted instead.
+	if len(layers) == 1 {
+		if err := MountReadOnlyBind(layers[0].DiffPath, mountPoint); err != nil {
+			return "", err
+		}
+	} else if err := MountOverlayFrom(storageDir, mountPoint, lowerDirs); err != nil {
+		return "", err
 	}
 
 	container.MountPath = mountPoint
+	container.Layers, container.layerRoot = layers, layerRoot
 	log.Printf("Mounted ID %s in %s\n", container.ID, container.MountPath)
 
 	return container.MountPath, nil
@@ -154,15 +390,36 @@ func (container *Container) initialize(homePath string) error {
 	return nil
 }
 
-// initializeContainers finds and mounts containers
-func initializeContainers(rootdir string, match string) ([]Container, error) {
+// isLive reports whether the container is neither dead nor pending removal.
+func (container *Container) isLive() bool {
+	return !container.State.Dead && !container.State.RemovalInProgress
+}
+
+// listContainers reads the config of every live container in rootdir, from
+// Docker's containers directory and from a containers/storage store. Dead
+// containers are included if all is set.
+func listContainers(rootdir string, all bool) ([]Container, error) {
+	containers, err := listDockerContainers(rootdir, all)
+	storageContainers, storageErr := listContainersStorage(rootdir)
+	if err != nil && storageErr != nil {
+		return nil, err
+	}
+	if storageErr != nil && !errors.Is(storageErr, fs.ErrNotExist) {
+		log.Println("Error reading containers/storage:", storageErr)
+	}
+	return append(containers, storageContainers...), nil
+}
+
+// listDockerContainers reads the config of every live container in rootdir's
+// containers directory, or of every container if all is set
+func listDockerContainers(rootdir string, all bool) ([]Container, error) {
 	containersDir := filepath.Join(rootdir, "containers")
 	entries, err := os.ReadDir(containersDir)
 	if err != nil {
 		return nil, fmt.Errorf("reading containers directory: %w", err)
 	}
 
-	var mountedContainers []Container
+	var containers []Container
 
 	for _, entry := range entries {
 		if !entry.IsDir() {
@@ -176,13 +433,32 @@ func initializeContainers(rootdir string, match string) ([]Container, error) {
 			log.Println("Error initializing container:", err)
 			continue
 		}
+		container.Platform = dockerImagePlatform(rootdir, container.Image)
 
 		// Skip dead or pending-removal containers
-		if container.State.Dead || container.State.RemovalInProgress {
+		if !all && !container.isLive() {
 			log.Printf("Skipping dead container: %s (%s)", container.Name, container.ID)
 			continue
 		}
 
+		containers = append(containers, container)
+	}
+
+	return containers, nil
+}
+
+// findContainers returns the containers in rootdir matching by ID prefix or
+// by label, followed by the labelled images no listed container was created
+// from, which are mounted directly
+func findContainers(rootdir string, match string) ([]Container, error) {
+	containers, err := listContainers(rootdir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Container
+
+	for _, container := range containers {
 		// Match by ID prefix or by label
 		matched := false
 		if strings.HasPrefix(container.ID, match) {
@@ -191,12 +467,49 @@ func initializeContainers(rootdir string, match string) ([]Container, error) {
 			matched = true
 		}
 
-		if !matched {
+		if matched {
+			found = append(found, container)
+		}
+	}
+
+	images, err := listImages(rootdir)
+	if err != nil {
+		log.Println("Error reading images:", err)
+	}
+	usedImages := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		usedImages[container.Image] = true
+	}
+	for _, image := range images {
+		if val, ok := image.Labels[match]; !ok || val != "overlay" || usedImages[image.Image] {
+			continue
+		}
+		// A dangling image, left behind when its tag moved to a newer
+		// pull, is no longer the OS block
+		if image.Name == image.Image {
+			if Debug {
+				log.Printf("Skipping dangling image %s", image.ID)
+			}
 			continue
 		}
+		found = append(found, image)
+	}
 
+	return found, nil
+}
+
+// initializeContainers finds and mounts containers
+func initializeContainers(rootdir string, match string) ([]Container, error) {
+	containers, err := findContainers(rootdir, match)
+	if err != nil {
+		return nil, err
+	}
+
+	var mountedContainers []Container
+	for _, container := range containers {
 		if _, err := container.mount(rootdir); err != nil {
 			log.Println("Failed to mount container:", err)
+			reportDropped(container, err.Error())
 		} else {
 			mountedContainers = append(mountedContainers, container)
 		}
@@ -213,13 +526,119 @@ func Mount(rootdir string, label string) ([]Container, error) {
 	return initializeContainers(rootdir, label)
 }
 
+// List returns the live containers in rootdir without mounting them
+func List(rootdir string) ([]Container, error) {
+	return listContainers(rootdir, false)
+}
+
+// ListAll returns every container in rootdir, dead ones included, followed
+// by the images in its image store, without mounting them
+func ListAll(rootdir string) ([]Container, error) {
+	containers, err := listContainers(rootdir, true)
+	if err != nil {
+		return nil, err
+	}
+	images, err := listImages(rootdir)
+	if err != nil {
+		log.Println("Error reading images:", err)
+	}
+	return append(containers, images...), nil
+}
+
+// IsImage reports whether the container is an image read from the image
+// store rather than a created container
+func (container *Container) IsImage() bool {
+	return container.Image == "sha256:"+container.ID
+}
+
+// ResolveLayers sets the container's Layers from rootdir without mounting it,
+// verifying them first as mounting would when VerifyLayers is set
+func (container *Container) ResolveLayers(rootdir string) error {
+	_, layers, err := container.layers(rootdir)
+	if err != nil {
+		return err
+	}
+	if VerifyLayers {
+		if err := container.verifyLayers(rootdir, layers); err != nil {
+			return err
+		}
+	}
+	container.Layers, container.layerRoot = layers, rootdir
+	return nil
+}
+
+// Find returns the containers Mount would mount, with their Layers resolved
+// but without mounting them. Containers whose layers cannot be resolved are
+// logged and skipped.
+func Find(rootdir string, label string) ([]Container, error) {
+	containers, err := findContainers(rootdir, label)
+	if err != nil {
+		return nil, err
+	}
+	var found []Container
+	for _, container := range containers {
+		if err := container.ResolveLayers(rootdir); err != nil {
+			log.Println("Failed to resolve container:", err)
+			reportDropped(container, err.Error())
+			continue
+		}
+		found = append(found, container)
+	}
+	return found, nil
+}
+
+// loadID reads the live container with exactly the given ID
+func loadID(rootdir string, id string) (Container, error) {
+	var container Container
+	if err := container.initialize(filepath.Join(rootdir, "containers", id)); err != nil {
+		return container, err
+	}
+	if !container.isLive() {
+		return container, fmt.Errorf("container %s (%s) is dead or pending removal", container.Name, id)
+	}
+	container.Platform = dockerImagePlatform(rootdir, container.Image)
+	return container, nil
+}
+
+// MountID mounts the container with exactly the given ID. Unlike Mount, which
+// logs and skips containers that fail to mount, it returns the reason the
+// container could not be mounted.
+func MountID(rootdir string, id string) (Container, error) {
+	container, err := loadID(rootdir, id)
+	if err != nil {
+		return container, err
+	}
+	if _, err := container.mount(rootdir); err != nil {
+		return container, err
+	}
+	return container, nil
+}
+
+// FindID is MountID without mounting: it resolves the container's Layers.
+func FindID(rootdir string, id string) (Container, error) {
+	container, err := loadID(rootdir, id)
+	if err != nil {
+		return container, err
+	}
+	err = container.ResolveLayers(rootdir)
+	return container, err
+}
+
 const (
 	HOSTOS_BLOCKS_OVERRIDE       = "io.balena.image.override"
 	HOSTOS_BLOCKS_KERNEL_VERSION = "io.balena.image.kernel-version"
 	HOSTOS_BLOCKS_KERNEL_ABI_ID  = "io.balena.image.kernel-abi-id"
+	HOSTOS_BLOCKS_REQUIRED       = "io.balena.image.required"
 	CMDLINE_KERNEL_ABI           = "balena_kernel_abi"
 )
 
+// IsRequired tells whether the OS block is labelled as one the device must
+// not boot without
+func (c *Container) IsRequired() bool {
+	required, _ := strconv.ParseBool(c.Labels[HOSTOS_BLOCKS_REQUIRED])
+	return required
+}
+
 // ParseHostKernelABIID extracts the balena_kernel_abi=<value> token from a
 // kernel cmdline string and returns its value. Returns "" when the token is
 // absent or carries an empty value, i.e. when the boot path ran a stock
@@ -234,6 +653,51 @@ func ParseHostKernelABIID(cmdline string) string {
 	return ""
 }
 
+// Sources of the host kernel ABI ID, as returned by HostKernelABIID
+const (
+	KERNEL_ABI_SOURCE_CMDLINE = "cmdline"
+	KERNEL_ABI_SOURCE_HOSTAPP = "hostapp"
+	KERNEL_ABI_SOURCE_BOOT    = "boot"
+)
+
+// HostKernelABIID returns the host kernel ABI ID and where it was found,
+// trying in turn the balena_kernel_abi cmdline token, the Module.symvers the
+// hostapp root ships for release, and bootABIID, which reads the ID shipped
+// in the boot partition and may be nil. Older bootloaders do not pass the
+// cmdline token. Returns "" with no source if none has it.
+func HostKernelABIID(cmdline string, root *Container, release string, bootABIID func() (string, error)) (string, string) {
+	id, source := hostKernelABIID(cmdline, root, release, bootABIID)
+	if source == "" {
+		log.Println("Host kernel ABI ID unknown")
+	} else {
+		log.Printf("Host kernel ABI ID %s from %s", id, source)
+	}
+	return id, source
+}
+
+func hostKernelABIID(cmdline string, root *Container, release string, bootABIID func() (string, error)) (string, string) {
+	if id := ParseHostKernelABIID(cmdline); id != "" {
+		return id, KERNEL_ABI_SOURCE_CMDLINE
+	}
+	if root != nil && release != "" {
+		id, err := root.ResolveExtensionABIID(release)
+		if err != nil {
+			log.Printf("Warning: kernel ABI ID of hostapp %s: %v", root.Name, err)
+		} else if id != "" {
+			return id, KERNEL_ABI_SOURCE_HOSTAPP
+		}
+	}
+	if bootABIID != nil {
+		id, err := bootABIID()
+		if err != nil {
+			log.Printf("Warning: kernel ABI ID of the boot partition: %v", err)
+		} else if id != "" {
+			return id, KERNEL_ABI_SOURCE_BOOT
+		}
+	}
+	return "", ""
+}
+
 // GetKernelRelease returns the running kernel's full release string
 // (e.g. "6.8.0-100-generic"), as reported by uname(2).
 func GetKernelRelease() (string, error) {
@@ -255,16 +719,29 @@ func kernelVersionFromRelease(release string) string {
 }
 
 // FilterByKernelVersion removes containers whose kernel-version label
-// doesn't match the running kernel. Containers without the label always pass.
-// An empty kernelVersion disables filtering.
-func FilterByKernelVersion(containers []Container, kernelVersion string) []Container {
-	if kernelVersion == "" {
+// doesn't match the running kernel release, or cannot be parsed (see
+// VersionConstraint). Containers without the label always pass. An empty
+// release disables filtering.
+func FilterByKernelVersion(containers []Container, release string) []Container {
+	if release == "" {
 		return containers
 	}
 	var filtered []Container
 	for _, c := range containers {
-		if labelVal, ok := c.Labels[HOSTOS_BLOCKS_KERNEL_VERSION]; ok && labelVal != kernelVersion {
-			log.Printf("Skipping container %s: kernel version %q != running %q", c.Name, labelVal, kernelVersion)
+		labelVal, ok := c.Labels[HOSTOS_BLOCKS_KERNEL_VERSION]
+		if !ok {
+			filtered = append(filtered, c)
+			continue
+		}
+		constraint, err := ParseVersionConstraint(labelVal)
+		if err != nil {
+			log.Printf("Error: dropping container %s: %s label: %v", c.Name, HOSTOS_BLOCKS_KERNEL_VERSION, err)
+			reportDropped(c, fmt.Sprintf("%s label: %v", HOSTOS_BLOCKS_KERNEL_VERSION, err))
+			continue
+		}
+		if !constraint.Matches(release) {
+			log.Printf("Skipping container %s: kernel version %q != running %q", c.Name, labelVal, release)
+			reportDropped(c, fmt.Sprintf("kernel version %q != running %q", labelVal, release))
 			continue
 		}
 		filtered = append(filtered, c)
@@ -297,13 +774,13 @@ func ComputeABIID(path string) (string, error) {
 // the computed value, or if a module-carrying extension cannot be verified
 // because release is empty (running kernel unknown).
 func (c *Container) ResolveExtensionABIID(release string) (string, error) {
-	if c.MountPath == "" {
+	if c.MountPath == "" && len(c.Layers) == 0 {
 		return "", nil
 	}
 
-	modulesRoot := filepath.Join(c.MountPath, "lib", "modules")
-	if _, err := os.Stat(modulesRoot); err != nil {
-		if os.IsNotExist(err) {
+	modulesRoot := filepath.Join("lib", "modules")
+	if _, err := c.Path(modulesRoot); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
 			return "", nil
 		}
 		return "", fmt.Errorf("stat %s: %w", modulesRoot, err)
@@ -313,18 +790,18 @@ func (c *Container) ResolveExtensionABIID(release string) (string, error) {
 		return "", fmt.Errorf("extension %s: running kernel release unknown", c.Name)
 	}
 	modDir := filepath.Join(modulesRoot, release)
-	if _, err := os.Stat(modDir); err != nil {
-		if os.IsNotExist(err) {
+	if _, err := c.Path(modDir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
 			return "", nil
 		}
 		return "", fmt.Errorf("stat %s: %w", modDir, err)
 	}
-	symversPath := filepath.Join(modDir, "Module.symvers")
-	if _, err := os.Stat(symversPath); err != nil {
-		if os.IsNotExist(err) {
-			return "", fmt.Errorf("broken extension %s: %s missing", c.Name, symversPath)
+	symversPath, err := c.Path(filepath.Join(modDir, "Module.symvers"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("broken extension %s: %s missing", c.Name, filepath.Join(c.MountPath, modDir, "Module.symvers"))
 		}
-		return "", fmt.Errorf("stat %s: %w", symversPath, err)
+		return "", fmt.Errorf("stat %s: %w", filepath.Join(modDir, "Module.symvers"), err)
 	}
 	id, err := ComputeABIID(symversPath)
 	if err != nil {
@@ -337,6 +814,30 @@ func (c *Container) ResolveExtensionABIID(release string) (string, error) {
 	return id, nil
 }
 
+// KernelRelease returns the release of the kernel a hostapp ships modules
+// for: the one directory under its /lib/modules. For an unmounted container
+// only the topmost layer's copy of the directory is listed.
+func (c *Container) KernelRelease() (string, error) {
+	dir, err := c.Path(filepath.Join("lib", "modules"))
+	if err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", dir, err)
+	}
+	var releases []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			releases = append(releases, entry.Name())
+		}
+	}
+	if len(releases) != 1 {
+		return "", fmt.Errorf("%s: expected one kernel release in /lib/modules, found %q", c.Name, releases)
+	}
+	return releases[0], nil
+}
+
 // FilterByKernelABIID keeps only those containers safe to mount over the
 // running kernel.
 //
@@ -349,6 +850,7 @@ func FilterByKernelABIID(containers []Container, release, hostABIID string) []Co
 		id, err := c.ResolveExtensionABIID(release)
 		if err != nil {
 			log.Printf("Error: dropping container %s: %v", c.Name, err)
+			reportDropped(*c, err.Error())
 			continue
 		}
 		if id == "" {
@@ -357,6 +859,7 @@ func FilterByKernelABIID(containers []Container, release, hostABIID string) []Co
 		}
 		if id != hostABIID {
 			log.Printf("Skipping container %s: kernel ABI ID %q != host %q", c.Name, id, hostABIID)
+			reportDropped(*c, fmt.Sprintf("kernel ABI ID %q != host %q", id, hostABIID))
 			continue
 		}
 		filtered = append(filtered, *c)
@@ -365,12 +868,21 @@ func FilterByKernelABIID(containers []Container, release, hostABIID string) []Co
 }
 
 // SelectMountable filters the already-mounted extensions down to those
-// compatible with the running kernel, unmounting every extension it drops.
-// Survivors stay mounted for use as overlay lowerdirs.
-func SelectMountable(containers []Container, release, hostABIID string) []Container {
-	selected := FilterByKernelVersion(containers, kernelVersionFromRelease(release))
+// compatible with host, the running kernel and each other (see
+// ResolveDependencies), unmounting every extension it drops. Survivors stay
+// mounted for use as overlay lowerdirs, each after those it requires.
+func SelectMountable(containers []Container, release, hostABIID string, host Host) []Container {
+	selected := FilterByPlatform(containers, host.Platform)
+	selected = FilterByDeviceType(selected, host.DeviceType)
+	selected = FilterByKernelVersion(selected, release)
 	selected = FilterByKernelABIID(selected, release, hostABIID)
+	selected = ResolveDependencies(selected)
+	unmountDropped(containers, selected)
+	return selected
+}
 
+// unmountDropped unmounts the containers that are not in selected
+func unmountDropped(containers, selected []Container) {
 	keep := make(map[string]bool, len(selected))
 	for _, c := range selected {
 		keep[c.MountPath] = true
@@ -383,18 +895,29 @@ func SelectMountable(containers []Container, release, hostABIID string) []Contai
 			log.Printf("Warning: failed to unmount dropped extension %s: %v", containers[i].Name, err)
 		}
 	}
-	return selected
 }
 
 // Extension represents an OS-block overlay extension. Extensions passed in
 // the leftExtensions slice of BuildOverlayOptions mount left of the hostapp
 // in lowerdir at their Priority (lower = higher overlayfs precedence, ties
 // broken by Name). Extensions passed in rightExtensions mount right of the
-// hostapp; their Priority field is ignored.
+// hostapp; their Priority field is ignored. MountPath may be relative to the
+// directory the overlay is mounted from (see MountOverlayFrom), which is what
+// the page-size budget is then computed on.
+//
+// LowerDirs lists the extension's layer directories, top first, and replaces
+// MountPath in the stack when set. A flat overlay (BuildFlatLowerDirs) only
+// stacks extensions with LowerDirs.
+//
+// Requires lists the names (see ExtensionName) of the extensions it requires
+// (see Container.Requires). An extension is dropped along with those it
+// requires when they do not fit the page-size budget.
 type Extension struct {
 	Name      string
 	MountPath string
 	Priority  int
+	LowerDirs []string
+	Requires  []string
 }
 
 // BuildOverlayOptions constructs an overlay lowerdir mount options string.
@@ -407,6 +930,51 @@ type Extension struct {
 // leftExtensions. Drops are logged per name. The set of extensions that fit
 // is logged in mount order.
 func BuildOverlayOptions(basePath string, leftExtensions, rightExtensions []Extension) string {
+	lowerDirs := BuildOverlayLowerDirs(basePath, leftExtensions, rightExtensions, os.Getpagesize()-1)
+	return "lowerdir=" + strings.Join(lowerDirs, ":")
+}
+
+// BuildOverlayLowerDirs orders basePath and the extensions into an overlay
+// lowerdir stack, highest precedence first, following the same rules as
+// BuildOverlayOptions. Extensions are only dropped when the equivalent
+// "lowerdir=" options string would reach limit bytes; a limit of 0 or less
+// keeps every extension, as mounts through the new mount API allow.
+func BuildOverlayLowerDirs(basePath string, leftExtensions, rightExtensions []Extension, limit int) []string {
+	return buildLowerDirs(basePath, []string{basePath}, leftExtensions, rightExtensions, limit)
+}
+
+// BuildFlatLowerDirs orders the hostapp's own layers (baseLowerDirs, top
+// first) and the layers of every extension into the lowerdir stack of a
+// single flat overlay, following the ordering and dropping rules of
+// BuildOverlayLowerDirs. Each extension contributes its LowerDirs and is kept
+// or dropped as a whole. Extensions without LowerDirs, which add no layers of
+// their own, are left out: their overlay mount would nest in the stack.
+func BuildFlatLowerDirs(baseLowerDirs []string, leftExtensions, rightExtensions []Extension, limit int) []string {
+	withLayers := func(extensions []Extension) []Extension {
+		var kept []Extension
+		for _, e := range extensions {
+			if len(e.LowerDirs) == 0 {
+				log.Printf("Extension %q adds no layers of its own, leaving it out", e.Name)
+				continue
+			}
+			kept = append(kept, e)
+		}
+		return kept
+	}
+	return buildLowerDirs("hostapp layers", baseLowerDirs, withLayers(leftExtensions), withLayers(rightExtensions), limit)
+}
+
+// lowerDirs returns the extension's lowerdirs, top first
+func (e Extension) lowerDirs() []string {
+	if len(e.LowerDirs) > 0 {
+		return e.LowerDirs
+	}
+	return []string{e.MountPath}
+}
+
+// buildLowerDirs implements BuildOverlayLowerDirs and BuildFlatLowerDirs.
+// baseName identifies the base in the log.
+func buildLowerDirs(baseName string, base []string, leftExtensions, rightExtensions []Extension, limit int) []string {
 	sort.Slice(leftExtensions, func(i, j int) bool {
 		if leftExtensions[i].Priority != leftExtensions[j].Priority {
 			return leftExtensions[i].Priority < leftExtensions[j].Priority
@@ -414,36 +982,51 @@ func BuildOverlayOptions(basePath string, leftExtensions, rightExtensions []Exte
 		return leftExtensions[i].Name < leftExtensions[j].Name
 	})
 
-	pageLimit := os.Getpagesize() - 1
+	// Requirements are only enforced among the extensions given: the rest
+	// is up to ResolveDependencies
+	known := make(map[string]bool)
+	for _, e := range append(append([]Extension{}, leftExtensions...), rightExtensions...) {
+		known[ExtensionName(e.Name)] = true
+	}
 
-	// Phase 1: prepend leftExtensions (highest priority first) while basePath still fits
-	prefix := "lowerdir="
-	leftIncluded := 0
-	for _, e := range leftExtensions {
-		candidate := prefix + e.MountPath + ":" + basePath
-		if len(candidate) >= pageLimit {
+	// An extension whose requirement did not fit is dropped too, which may
+	// leave room for others, so fit again until every requirement is met
+	left, right := leftExtensions, rightExtensions
+	var lowerDirs []string
+	var leftIncluded, rightIncluded int
+	for {
+		lowerDirs, leftIncluded, rightIncluded = fitLowerDirs(base, left, right, limit)
+		included := make(map[string]bool)
+		for _, e := range left[:leftIncluded] {
+			included[ExtensionName(e.Name)] = true
+		}
+		for _, e := range right[:rightIncluded] {
+			included[ExtensionName(e.Name)] = true
+		}
+		unmet := false
+		keepMet := func(extensions []Extension, n int) []Extension {
+			var kept []Extension
+			for i, e := range extensions {
+				if i < n {
+					if missing := missingRequirement(e, known, included); missing != "" {
+						log.Printf("Warning: extension %q dropped as it requires %q, dropped due to page size limit", e.Name, missing)
+						unmet = true
+						continue
+					}
+				}
+				kept = append(kept, e)
+			}
+			return kept
+		}
+		left, right = keepMet(left, leftIncluded), keepMet(right, rightIncluded)
+		if !unmet {
 			break
 		}
-		prefix += e.MountPath + ":"
-		leftIncluded++
 	}
-	for _, e := range leftExtensions[leftIncluded:] {
+	for _, e := range left[leftIncluded:] {
 		log.Printf("Warning: extension %q dropped due to page size limit", e.Name)
 	}
-
-	opts := prefix + basePath
-
-	// Phase 2: append rightExtensions as space allows
-	rightIncluded := 0
-	for _, e := range rightExtensions {
-		candidate := opts + ":" + e.MountPath
-		if len(candidate) >= pageLimit {
-			break
-		}
-		opts = candidate
-		rightIncluded++
-	}
-	for _, e := range rightExtensions[rightIncluded:] {
+	for _, e := range right[rightIncluded:] {
 		log.Printf("Warning: extension %q dropped due to page size limit", e.Name)
 	}
 
@@ -451,17 +1034,68 @@ func BuildOverlayOptions(basePath string, leftExtensions, rightExtensions []Exte
 	log.Println("Overlayed images:")
 	idx := 0
 	for i := 0; i < leftIncluded; i++ {
-		e := leftExtensions[i]
+		e := left[i]
 		log.Printf("\t[%d] %s (left, priority=%d)", idx, e.Name, e.Priority)
 		idx++
 	}
-	log.Printf("\t[%d] %s (hostapp)", idx, basePath)
+	log.Printf("\t[%d] %s (hostapp)", idx, baseName)
 	idx++
 	for i := 0; i < rightIncluded; i++ {
-		e := rightExtensions[i]
+		e := right[i]
 		log.Printf("\t[%d] %s (right)", idx, e.Name)
 		idx++
 	}
 
-	return opts
+	return lowerDirs
+}
+
+// missingRequirement returns the first of the known extensions e requires
+// that is not included, or ""
+func missingRequirement(e Extension, known, included map[string]bool) string {
+	for _, name := range e.Requires {
+		if known[name] && !included[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// fitLowerDirs stacks the sorted leftExtensions (highest priority first),
+// the base and the rightExtensions as long as they fit limit, and returns the
+// lowerdirs with how many of the left and right extensions are included
+func fitLowerDirs(base []string, leftExtensions, rightExtensions []Extension, limit int) ([]string, int, int) {
+	fits := func(size int) bool {
+		return limit <= 0 || size < limit
+	}
+	basePath := strings.Join(base, ":")
+
+	// Phase 1: prepend leftExtensions (highest priority first) while basePath still fits
+	size := len("lowerdir=")
+	var lowerDirs []string
+	leftIncluded := 0
+	for _, e := range leftExtensions {
+		dirs := strings.Join(e.lowerDirs(), ":")
+		if !fits(size + len(dirs) + 1 + len(basePath)) {
+			break
+		}
+		size += len(dirs) + 1
+		lowerDirs = append(lowerDirs, e.lowerDirs()...)
+		leftIncluded++
+	}
+
+	size += len(basePath)
+	lowerDirs = append(lowerDirs, base...)
+
+	// Phase 2: append rightExtensions as space allows
+	rightIncluded := 0
+	for _, e := range rightExtensions {
+		dirs := strings.Join(e.lowerDirs(), ":")
+		if !fits(size + 1 + len(dirs)) {
+			break
+		}
+		size += 1 + len(dirs)
+		lowerDirs = append(lowerDirs, e.lowerDirs()...)
+		rightIncluded++
+	}
+	return lowerDirs, leftIncluded, rightIncluded
 }
@@ -854,6 +854,20 @@ func TestFilterByKernelVersion(t *testing.T) {
 	}
 }
 
+func TestDroppedReportsFilteredContainers(t *testing.T) {
+	reasons := map[string]string{}
+	Dropped = func(c Container, reason string) { reasons[c.Name] = reason }
+	defer func() { Dropped = nil }()
+
+	FilterByKernelVersion([]Container{
+		makeTestContainer("keep", map[string]string{HOSTOS_BLOCKS_KERNEL_VERSION: "6.1.0"}),
+		makeTestContainer("drop", map[string]string{HOSTOS_BLOCKS_KERNEL_VERSION: "5.15.0"}),
+	}, "6.1.0")
+	if len(reasons) != 1 || reasons["drop"] != `kernel version "5.15.0" != running "6.1.0"` {
+		t.Errorf("unexpected drop reasons %v", reasons)
+	}
+}
+
 func TestComputeABIID(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "Module.symvers")
@@ -900,6 +914,39 @@ func TestParseHostKernelABIID(t *testing.T) {
 	}
 }
 
+func TestHostKernelABIID(t *testing.T) {
+	const release = "6.1.0-test"
+	root := writeConfigV2(t, "hostapp", nil, nil)
+	root.MountPath = t.TempDir()
+	boot := func() (string, error) { return "boot-abi", nil }
+
+	// Without the cmdline token or hostapp modules, the boot partition's
+	if id, source := HostKernelABIID("console=ttyS0", &root, release, boot); id != "boot-abi" || source != KERNEL_ABI_SOURCE_BOOT {
+		t.Errorf("expected the boot partition's ID, got %q from %q", id, source)
+	}
+	if id, source := HostKernelABIID("console=ttyS0", &root, release, nil); id != "" || source != "" {
+		t.Errorf("expected no ID, got %q from %q", id, source)
+	}
+
+	modules := filepath.Join(root.MountPath, "lib", "modules", release)
+	if err := os.MkdirAll(modules, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(modules, "Module.symvers"), []byte("symbols"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ComputeABIID(filepath.Join(modules, "Module.symvers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, source := HostKernelABIID("console=ttyS0", &root, release, boot); id != want || source != KERNEL_ABI_SOURCE_HOSTAPP {
+		t.Errorf("expected the hostapp's ID %q, got %q from %q", want, id, source)
+	}
+	if id, source := HostKernelABIID("balena_kernel_abi=cmdline-abi", &root, release, boot); id != "cmdline-abi" || source != KERNEL_ABI_SOURCE_CMDLINE {
+		t.Errorf("expected the cmdline's ID, got %q from %q", id, source)
+	}
+}
+
 // writeConfigV2 writes the given root map as config.v2.json in a temp home
 // directory and returns a Container with HomePath populated. The Labels map
 // is linked to the one written into the JSON so in-memory state matches disk.
@@ -1084,6 +1131,32 @@ func TestResolveExtensionABIID(t *testing.T) {
 	})
 }
 
+func TestKernelRelease(t *testing.T) {
+	c := writeConfigV2(t, "hostapp", nil, nil)
+	c.MountPath = t.TempDir()
+	if _, err := c.KernelRelease(); err == nil {
+		t.Errorf("expected an error without /lib/modules")
+	}
+
+	modules := filepath.Join(c.MountPath, "lib", "modules")
+	if err := os.MkdirAll(filepath.Join(modules, "6.1.0-test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(modules, "modules.conf"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.KernelRelease(); err != nil || got != "6.1.0-test" {
+		t.Errorf("expected 6.1.0-test, got %q (%v)", got, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(modules, "6.2.0-test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.KernelRelease(); err == nil {
+		t.Errorf("expected an error with two kernel releases")
+	}
+}
+
 // abiKind selects how buildFilterContainer provisions an extension's mount.
 type abiKind int
 
@@ -1263,7 +1336,7 @@ func TestSelectMountable(t *testing.T) {
 		}, MountPath: dropPath},
 	}
 
-	selected := SelectMountable(all, "6.0.0", "")
+	selected := SelectMountable(all, "6.0.0", "", Host{})
 	if len(selected) != 1 || selected[0].ID != "keepid" {
 		t.Fatalf("expected only keepid selected, got %+v", selected)
 	}
@@ -1283,3 +1356,265 @@ func TestSelectMountable(t *testing.T) {
 		t.Errorf("dropped MountPath should be cleared, got %q", all[1].MountPath)
 	}
 }
+
+// writeOverlay2Container lays out a container under root the way dockerd's
+// overlay2 driver does: containers/<id>/config.v2.json, the layerdb mount-id,
+// and one overlay2 layer per entry of layers (top layer first) holding the
+// given files, chained through l/ short links and the top layer's lower file.
+// An init layer carrying .dockerenv sits below the top layer. Returns the
+// container, not yet mounted.
+func writeOverlay2Container(t *testing.T, root, name string, labels map[string]string, layers []map[string]string) Container {
+	t.Helper()
+	id := "cid-" + name
+	home := filepath.Join(root, "containers", id)
+	if err := os.MkdirAll(home, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := json.Marshal(map[string]interface{}{
+		"ID":     id,
+		"Name":   name,
+		"Driver": "overlay2",
+		"Config": map[string]interface{}{"Labels": labels},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, "config.v2.json"), cfg, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	overlay2Dir := filepath.Join(root, "overlay2")
+	if err := os.MkdirAll(filepath.Join(overlay2Dir, "l"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLayer := func(layerID, link string, files map[string]string) {
+		diff := filepath.Join(overlay2Dir, layerID, "diff")
+		if err := os.MkdirAll(diff, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for path, content := range files {
+			full := filepath.Join(diff, path)
+			if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(overlay2Dir, layerID, "link"), []byte(link), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join("..", layerID, "diff"), filepath.Join(overlay2Dir, "l", link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mountID := name + "-layer0"
+	var lower []string
+	for i, files := range layers {
+		layerID := fmt.Sprintf("%s-layer%d", name, i)
+		link := strings.ToUpper(fmt.Sprintf("%s%d", name, i))
+		writeLayer(layerID, link, files)
+		if i == 0 {
+			writeLayer(mountID+"-init", strings.ToUpper(name)+"INIT", map[string]string{".dockerenv": ""})
+			lower = append(lower, "l/"+strings.ToUpper(name)+"INIT")
+			continue
+		}
+		lower = append(lower, "l/"+link)
+	}
+	if len(lower) > 0 {
+		if err := os.WriteFile(filepath.Join(overlay2Dir, mountID, "lower"), []byte(strings.Join(lower, ":")), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mountsDir := filepath.Join(root, "image", "overlay2", "layerdb", "mounts", id)
+	if err := os.MkdirAll(mountsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mountsDir, "mount-id"), []byte(mountID), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return Container{
+		Config: Config{
+			HostConfig: HostConfig{Labels: labels},
+			ID:         id,
+			Name:       name,
+			Driver:     "overlay2",
+		},
+		HomePath: home,
+	}
+}
+
+// TestContainerLayers verifies that the layer chain is named by overlay2
+// short links and leaves out the init layer.
+func TestContainerLayers(t *testing.T) {
+	root := t.TempDir()
+	c := writeOverlay2Container(t, root, "app", nil, []map[string]string{
+		{"top": "0"}, {"middle": "1"}, {"bottom": "2"},
+	})
+
+	layerDir, layers, err := c.layers(root)
+	if err != nil {
+		t.Fatalf("layers: %v", err)
+	}
+	if want := filepath.Join(root, "overlay2", "app-layer0"); layerDir != want {
+		t.Errorf("expected layer directory %s, got %q", want, layerDir)
+	}
+	var links, ids []string
+	for _, l := range layers {
+		links = append(links, l.Link)
+		ids = append(ids, l.ID)
+		if !filepath.IsAbs(l.DiffPath) {
+			t.Errorf("DiffPath %q should be absolute", l.DiffPath)
+		}
+	}
+	if want := []string{"l/APP0", "l/APP1", "l/APP2"}; !reflect.DeepEqual(links, want) {
+		t.Errorf("expected links %v, got %v", want, links)
+	}
+	if want := []string{"app-layer0", "app-layer1", "app-layer2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("expected layer IDs %v, got %v", want, ids)
+	}
+
+	// Layers without a link file fall back to the absolute diff path
+	if err := os.Remove(filepath.Join(layerDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	_, layers, err = c.layers(root)
+	if err != nil {
+		t.Fatalf("layers: %v", err)
+	}
+	if layers[0].Link != layers[0].DiffPath {
+		t.Errorf("expected absolute diff path for top layer, got %q", layers[0].Link)
+	}
+}
+
+// TestMountShortLinks mounts a container through its short links and checks
+// the merged view.
+func TestMountShortLinks(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to perform overlay mount")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("unshare: %v", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("make mounts private: %v", err)
+	}
+
+	root := t.TempDir()
+	writeOverlay2Container(t, root, "app", nil, []map[string]string{
+		{"etc/release": "top"}, {"etc/release": "bottom", "bin/sh": "sh"},
+	})
+	wd, _ := os.Getwd()
+
+	c, err := MountID(root, "cid-app")
+	if err != nil {
+		t.Fatalf("MountID: %v", err)
+	}
+	defer unix.Unmount(c.MountPath, unix.MNT_DETACH)
+
+	if got, _ := os.Getwd(); got != wd {
+		t.Errorf("working directory changed to %q", got)
+	}
+	if content, err := os.ReadFile(filepath.Join(c.MountPath, "etc", "release")); err != nil || string(content) != "top" {
+		t.Errorf("expected top layer to win, got %q (%v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(c.MountPath, "bin", "sh")); err != nil {
+		t.Errorf("expected lower layer file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(c.MountPath, ".dockerenv")); !os.IsNotExist(err) {
+		t.Errorf("init layer should not be mounted: %v", err)
+	}
+}
+
+// writeChainIDs records chain IDs for the given overlay2 layer directories in
+// root's layerdb, as dockerd does in layerdb/sha256/<chain>/cache-id.
+func writeChainIDs(t *testing.T, root string, chainIDs map[string]string) {
+	t.Helper()
+	for layerID, chainID := range chainIDs {
+		dir := filepath.Join(root, "image", "overlay2", "layerdb", "sha256", chainID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "cache-id"), []byte(layerID), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOwnLayers(t *testing.T) {
+	hostRoot := t.TempDir()
+	dataRoot := t.TempDir()
+	host := writeOverlay2Container(t, hostRoot, "hostapp", nil, []map[string]string{{}, {}, {}})
+	writeChainIDs(t, hostRoot, map[string]string{"hostapp-layer1": "c1", "hostapp-layer2": "c2"})
+	// The extension is built FROM the hostapp: its two bottom layers carry
+	// the hostapp's chain IDs in another storage root
+	ext := writeOverlay2Container(t, dataRoot, "ext", nil, []map[string]string{{}, {}, {}, {}})
+	writeChainIDs(t, dataRoot, map[string]string{"ext-layer1": "e1", "ext-layer2": "c1", "ext-layer3": "c2"})
+
+	var err error
+	if _, host.Layers, err = host.layers(hostRoot); err != nil {
+		t.Fatal(err)
+	}
+	if _, ext.Layers, err = ext.layers(dataRoot); err != nil {
+		t.Fatal(err)
+	}
+	if ext.Layers[2].ChainID != "sha256:c1" {
+		t.Fatalf("expected chain ID sha256:c1, got %q", ext.Layers[2].ChainID)
+	}
+
+	var ids []string
+	for _, l := range ext.OwnLayers(&host) {
+		ids = append(ids, l.ID)
+	}
+	if want := []string{"ext-layer0", "ext-layer1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("expected own layers %v, got %v", want, ids)
+	}
+
+	// Within one storage root, layers are also matched by diff directory
+	sibling := Container{Config: Config{Name: "sibling"}, Layers: []Layer{
+		{ID: "own", DiffPath: "/own/diff"},
+		host.Layers[1],
+		host.Layers[2],
+	}}
+	if own := sibling.OwnLayers(&host); len(own) != 1 || own[0].ID != "own" {
+		t.Errorf("expected only the sibling's own layer, got %+v", own)
+	}
+
+	unrelated := Container{Config: Config{Name: "unrelated"}, Layers: []Layer{{ID: "u0", DiffPath: "/u0"}, {ID: "u1", DiffPath: "/u1", ChainID: "sha256:u1"}}}
+	if own := unrelated.OwnLayers(&host); len(own) != 2 {
+		t.Errorf("expected every layer of an unrelated container, got %+v", own)
+	}
+}
+
+func TestHasDeletions(t *testing.T) {
+	type test struct {
+		name   string
+		layers []Layer
+		want   bool
+	}
+	plain := writeShadowLayer(t, "plain", map[string]string{"usr/bin/tool": "tool"})
+	aufs := writeShadowLayer(t, "aufs", map[string]string{"etc/.wh.issue": ""})
+	tests := []test{
+		{"none", nil, false},
+		{"plain", []Layer{plain}, false},
+		{"aufs whiteout", []Layer{plain, aufs}, true},
+	}
+	// Whiteouts and opaque directories need root
+	if os.Getuid() == 0 {
+		tests = append(tests,
+			test{"whiteout", []Layer{writeShadowLayer(t, "whiteout", map[string]string{"etc/issue": "whiteout"})}, true},
+			test{"opaque directory", []Layer{writeShadowLayer(t, "opaque", map[string]string{"opt/vendor": "opaque"})}, true},
+		)
+	}
+	for _, tt := range tests {
+		got, err := HasDeletions(tt.layers)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: expected %v, got %v (%v)", tt.name, tt.want, got, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package hostapp
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxSymlinks bounds symlink resolution in Path, as the kernel's MAXSYMLINKS
+const maxSymlinks = 40
+
+// Path returns where the file at rel, a path in the container's root
+// filesystem, can be read. For a mounted container it is under MountPath.
+// Otherwise it is looked up through the container's Layers, top first, the
+// way the overlay would resolve it: whiteouts hide lower layers and symlinks
+// are followed within the container. Opaque directories are not taken into
+// account. The error wraps fs.ErrNotExist if there is no such file.
+func (c *Container) Path(rel string) (string, error) {
+	if c.MountPath != "" {
+		path := filepath.Join(c.MountPath, filepath.Join("/", rel))
+		if _, err := os.Stat(path); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	if len(c.Layers) == 0 {
+		return "", fmt.Errorf("container %s is neither mounted nor has known layers", c.Name)
+	}
+
+	components := splitPath(rel)
+	resolved := ""
+	real := c.Layers[0].DiffPath
+	for links := 0; len(components) > 0; {
+		next := filepath.Join(resolved, components[0])
+		path, fi, err := c.lookupLayers(next)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", rel, err)
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved, real, components = next, path, components[1:]
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%s: %w", rel, syscall.ELOOP)
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(resolved, target)
+		}
+		// Start over from the root with the link target
+		components = append(splitPath(target), components[1:]...)
+		resolved = ""
+		real = c.Layers[0].DiffPath
+	}
+	return real, nil
+}
+
+// lookupLayers returns the topmost layer's copy of rel, a path without
+// symlinks, and its file info
+func (c *Container) lookupLayers(rel string) (string, fs.FileInfo, error) {
+	for _, layer := range c.Layers {
+		path := filepath.Join(layer.DiffPath, rel)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", nil, err
+		}
+		if isWhiteout(fi) {
+			break
+		}
+		return path, fi, nil
+	}
+	return "", nil, fs.ErrNotExist
+}
+
+// isWhiteout tells whether fi is an overlayfs whiteout, a 0/0 character device
+func isWhiteout(fi fs.FileInfo) bool {
+	if fi.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// splitPath returns the components of p, without . and .. leaving the root
+func splitPath(p string) []string {
+	p = strings.TrimPrefix(filepath.Join("/", p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
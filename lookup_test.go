@@ -0,0 +1,67 @@
+package hostapp
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContainerPath(t *testing.T) {
+	root := t.TempDir()
+	layer := func(name string, files map[string]string) Layer {
+		diff := filepath.Join(root, name, "diff")
+		for path, content := range files {
+			full := filepath.Join(diff, path)
+			if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if target, ok := strings.CutPrefix(content, "->"); ok {
+				if err := os.Symlink(target, full); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return Layer{ID: name, DiffPath: diff}
+	}
+	c := Container{Config: Config{Name: "block"}, Layers: []Layer{
+		layer("top", map[string]string{
+			"etc/issue":  "top",
+			"bin":        "->usr/bin",
+			"etc/init":   "->/bin/sh",
+			"etc/loop":   "->loop",
+			"etc/escape": "->../../../../outside",
+		}),
+		layer("base", map[string]string{
+			"etc/issue":  "base",
+			"etc/hosts":  "base",
+			"usr/bin/sh": "sh",
+		}),
+	}}
+
+	tests := map[string]string{
+		"etc/issue":  filepath.Join(root, "top", "diff", "etc", "issue"),
+		"/etc/hosts": filepath.Join(root, "base", "diff", "etc", "hosts"),
+		"bin/sh":     filepath.Join(root, "base", "diff", "usr", "bin", "sh"),
+		"etc/init":   filepath.Join(root, "base", "diff", "usr", "bin", "sh"),
+	}
+	for rel, want := range tests {
+		if got, err := c.Path(rel); err != nil || got != want {
+			t.Errorf("Path(%q): expected %s, got %s (%v)", rel, want, got, err)
+		}
+	}
+
+	if _, err := c.Path("etc/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing file to not exist, got %v", err)
+	}
+	if _, err := c.Path("etc/escape"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected symlinks to stay within the container, got %v", err)
+	}
+	if _, err := c.Path("etc/loop"); err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a symlink loop error, got %v", err)
+	}
+}
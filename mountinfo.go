@@ -0,0 +1,183 @@
+package hostapp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrMountConflict is returned when a container's mount point already has
+// something other than the container's layers mounted on it
+var ErrMountConflict = errors.New("mount point in use")
+
+// mountInfoPaths are tried in turn: the calling thread's mounts, which
+// differ from the process' after unshare(CLONE_NEWNS) on a locked thread,
+// then the process'
+var mountInfoPaths = []string{"/proc/thread-self/mountinfo", "/proc/self/mountinfo"}
+
+// MountEntry is a line of /proc/self/mountinfo
+type MountEntry struct {
+	MountPoint   string
+	FSType       string
+	Source       string
+	SuperOptions []string
+}
+
+// ReadMountInfo parses the mount table of the calling thread, in mount order
+func ReadMountInfo() ([]MountEntry, error) {
+	var f *os.File
+	var err error
+	for _, path := range mountInfoPaths {
+		if f, err = os.Open(path); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening mountinfo: %w", err)
+	}
+	defer f.Close()
+
+	var entries []MountEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// ID PARENT MAJOR:MINOR ROOT MOUNTPOINT OPTIONS [OPTIONAL...] - FSTYPE SOURCE SUPEROPTIONS
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || len(fields) < sep+4 {
+			continue
+		}
+		entry := MountEntry{
+			MountPoint: unescapeMountInfo(fields[4]),
+			FSType:     fields[sep+1],
+			Source:     unescapeMountInfo(fields[sep+2]),
+		}
+		// Commas in option values are escaped, so splitting is safe
+		for _, opt := range strings.Split(fields[sep+3], ",") {
+			entry.SuperOptions = append(entry.SuperOptions, unescapeMountInfo(opt))
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading mountinfo: %w", err)
+	}
+	return entries, nil
+}
+
+// unescapeMountInfo decodes the octal escapes (\040 for a space) of a
+// mountinfo field
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// lowerDirs returns the lowerdirs of an overlay mount, whether they were
+// passed as a single lowerdir= option or one lowerdir+= option each
+func (entry MountEntry) lowerDirs() []string {
+	var dirs []string
+	for _, opt := range entry.SuperOptions {
+		if value, ok := strings.CutPrefix(opt, "lowerdir+="); ok {
+			dirs = append(dirs, value)
+		} else if value, ok := strings.CutPrefix(opt, "lowerdir="); ok {
+			dirs = append(dirs, splitLowerDirs(value)...)
+		}
+	}
+	return dirs
+}
+
+// splitLowerDirs splits a lowerdir= value on the colons not escaped with a
+// backslash
+func splitLowerDirs(value string) []string {
+	var dirs []string
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value):
+			i++
+			b.WriteByte(value[i])
+		case value[i] == ':':
+			dirs = append(dirs, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return append(dirs, b.String())
+}
+
+// mountedAt returns the topmost mount on mountPoint, or nil if there is none
+func mountedAt(mountPoint string) (*MountEntry, error) {
+	entries, err := ReadMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	mountPoint = filepath.Clean(mountPoint)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].MountPoint == mountPoint {
+			return &entries[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// mountsLayers tells whether entry, mounted on mountPoint, is the mount of
+// layers that mount() would make: an overlay of the same lowerdirs,
+// relative ones resolved against storageDir, or for a single layer a bind
+// mount of its diff directory.
+func (entry MountEntry) mountsLayers(mountPoint, storageDir string, layers []Layer) bool {
+	if len(layers) == 1 {
+		var mounted, diff unix.Stat_t
+		if unix.Stat(mountPoint, &mounted) != nil || unix.Stat(layers[0].DiffPath, &diff) != nil {
+			return false
+		}
+		return entry.FSType != "overlay" && mounted.Dev == diff.Dev && mounted.Ino == diff.Ino
+	}
+
+	if entry.FSType != "overlay" {
+		return false
+	}
+	abs := func(dir string) string {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(storageDir, dir)
+		}
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return resolved
+		}
+		return filepath.Clean(dir)
+	}
+	mounted := entry.lowerDirs()
+	if len(mounted) != len(layers) {
+		return false
+	}
+	for i, layer := range layers {
+		if abs(mounted[i]) != abs(layer.DiffPath) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,327 @@
+package hostapp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMountEntryLowerDirs(t *testing.T) {
+	tests := map[string][]string{
+		"ro,lowerdir=l/A:l/B,redirect_dir=on":              {"l/A", "l/B"},
+		"ro,lowerdir+=l/A,lowerdir+=l/B,redirect_dir=on":   {"l/A", "l/B"},
+		`ro,lowerdir=/a\:b:/c\134\134d`:                    {"/a:b", `/c\d`},
+		"rw,lowerdir=/lower,upperdir=/upper,workdir=/work": {"/lower"},
+		"rw,relatime": nil,
+	}
+	for opts, want := range tests {
+		var entry MountEntry
+		for _, opt := range strings.Split(opts, ",") {
+			entry.SuperOptions = append(entry.SuperOptions, unescapeMountInfo(opt))
+		}
+		if got := entry.lowerDirs(); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: expected %q, got %q", opts, want, got)
+		}
+	}
+}
+
+func TestMountIsIdempotent(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to perform overlay mount")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("unshare: %v", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("make mounts private: %v", err)
+	}
+
+	root := t.TempDir()
+	countMounts := func(mountPoint string) int {
+		entries, err := ReadMountInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, entry := range entries {
+			if entry.MountPoint == mountPoint {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, layers := range [][]map[string]string{{{"etc/issue": "top"}, {"etc/hosts": "base"}}, {{"etc/issue": "single"}}} {
+		c := writeOverlay2Container(t, root, "hostapp"+string(rune('0'+len(layers))), nil, layers)
+		first, err := MountID(root, c.ID)
+		if err != nil {
+			t.Fatalf("MountID: %v", err)
+		}
+		defer unix.Unmount(first.MountPath, unix.MNT_DETACH)
+		second, err := MountID(root, c.ID)
+		if err != nil {
+			t.Fatalf("MountID again: %v", err)
+		}
+		if second.MountPath != first.MountPath || len(second.Layers) != len(layers) {
+			t.Errorf("expected the mount at %s to be reused, got %+v", first.MountPath, second)
+		}
+		if n := countMounts(first.MountPath); n != 1 {
+			t.Errorf("expected one mount on %s, got %d", first.MountPath, n)
+		}
+	}
+
+	// Anything else on the mount point is a conflict
+	c := writeOverlay2Container(t, root, "conflict", nil, []map[string]string{{"etc/issue": "top"}, {}})
+	_, layers, err := c.layers(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountPoint := filepath.Join(filepath.Dir(layers[0].DiffPath), "merged")
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mount("tmpfs", mountPoint, "tmpfs", 0, ""); err != nil {
+		t.Fatalf("mounting tmpfs: %v", err)
+	}
+	defer unix.Unmount(mountPoint, unix.MNT_DETACH)
+	if _, err := MountID(root, c.ID); !errors.Is(err, ErrMountConflict) {
+		t.Errorf("expected ErrMountConflict, got %v", err)
+	}
+}
+
+func TestReadMountInfo_RealMounts(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// Create new mount namespace to isolate test mounts
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("failed to create mount namespace: %v", err)
+	}
+
+	// Make mounts private so changes don't propagate
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("failed to make mounts private: %v", err)
+	}
+
+	// Create and mount a tmpfs
+	tmpDir := t.TempDir()
+	if err := unix.Mount("tmpfs", tmpDir, "tmpfs", 0, ""); err != nil {
+		t.Fatalf("failed to mount tmpfs: %v", err)
+	}
+	defer unix.Unmount(tmpDir, 0)
+
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		t.Fatalf("ReadMountInfo failed: %v", err)
+	}
+
+	found := false
+	for _, mount := range mounts {
+		if mount.MountPoint == tmpDir {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		t.Errorf("expected tmpfs mount at %s to appear in mounts list", tmpDir)
+	}
+}
+
+func TestReadMountInfo_ParsesMultipleMounts(t *testing.T) {
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		t.Fatalf("ReadMountInfo failed: %v", err)
+	}
+
+	// Any system should have at least root and a few other mounts
+	if len(mounts) < 2 {
+		t.Errorf("expected at least 2 mounts, got %d", len(mounts))
+	}
+}
+
+func TestReadMountInfo_NoDuplicateRoots(t *testing.T) {
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		t.Fatalf("ReadMountInfo failed: %v", err)
+	}
+
+	rootCount := 0
+	for _, mount := range mounts {
+		if mount.MountPoint == "/" {
+			rootCount++
+		}
+	}
+
+	if rootCount > 1 {
+		t.Errorf("root mount appeared %d times, expected 1", rootCount)
+	}
+}
+
+func TestReadMountInfo_NestedMounts(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("failed to create mount namespace: %v", err)
+	}
+
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("failed to make mounts private: %v", err)
+	}
+
+	// Create nested mount structure
+	parentDir := t.TempDir()
+	childDir := filepath.Join(parentDir, "child")
+	if err := os.MkdirAll(childDir, 0755); err != nil {
+		t.Fatalf("failed to create child dir: %v", err)
+	}
+
+	if err := unix.Mount("tmpfs", parentDir, "tmpfs", 0, ""); err != nil {
+		t.Fatalf("failed to mount parent tmpfs: %v", err)
+	}
+	defer unix.Unmount(parentDir, unix.MNT_DETACH)
+
+	// Recreate child dir after mounting parent
+	if err := os.MkdirAll(childDir, 0755); err != nil {
+		t.Fatalf("failed to create child dir after mount: %v", err)
+	}
+
+	if err := unix.Mount("tmpfs", childDir, "tmpfs", 0, ""); err != nil {
+		t.Fatalf("failed to mount child tmpfs: %v", err)
+	}
+	defer unix.Unmount(childDir, unix.MNT_DETACH)
+
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		t.Fatalf("ReadMountInfo failed: %v", err)
+	}
+
+	parentFound, childFound := false, false
+	for _, mount := range mounts {
+		if mount.MountPoint == parentDir {
+			parentFound = true
+		}
+		if mount.MountPoint == childDir {
+			childFound = true
+		}
+	}
+
+	if !parentFound {
+		t.Error("expected parent mount to appear in mounts list")
+	}
+	if !childFound {
+		t.Error("expected child mount to appear in mounts list")
+	}
+}
+
+func TestReadMountInfo_ContainsStandardMounts(t *testing.T) {
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		t.Fatalf("ReadMountInfo failed: %v", err)
+	}
+
+	// Build set for quick lookup
+	mountSet := make(map[string]bool)
+	for _, m := range mounts {
+		mountSet[m.MountPoint] = true
+	}
+
+	// These should exist on any Linux system running tests
+	standardMounts := []string{"/", "/proc", "/sys"}
+	for _, expected := range standardMounts {
+		if !mountSet[expected] {
+			// Check if it might be a prefix match (sometimes paths are slightly different)
+			found := false
+			for m := range mountSet {
+				if strings.HasPrefix(m, expected) || expected == m {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("expected standard mount %s not found", expected)
+			}
+		}
+	}
+}
+
+func TestUnescapeMountInfo_NoEscape(t *testing.T) {
+	input := "/mnt/data"
+	result := unescapeMountInfo(input)
+	if result != input {
+		t.Errorf("expected %q, got %q", input, result)
+	}
+}
+
+func TestUnescapeMountInfo_Space(t *testing.T) {
+	// \040 is octal for space (32)
+	input := "/mnt/my\\040data"
+	expected := "/mnt/my data"
+	result := unescapeMountInfo(input)
+	if result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+}
+
+func TestUnescapeMountInfo_Tab(t *testing.T) {
+	// \011 is octal for tab (9)
+	input := "/mnt/my\\011data"
+	expected := "/mnt/my\tdata"
+	result := unescapeMountInfo(input)
+	if result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+}
+
+func TestUnescapeMountInfo_Backslash(t *testing.T) {
+	// \134 is octal for backslash (92)
+	input := "/mnt/my\\134data"
+	expected := "/mnt/my\\data"
+	result := unescapeMountInfo(input)
+	if result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+}
+
+func TestUnescapeMountInfo_Multiple(t *testing.T) {
+	// Multiple escapes
+	input := "/mnt/my\\040data\\040here"
+	expected := "/mnt/my data here"
+	result := unescapeMountInfo(input)
+	if result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+}
+
+func TestUnescapeMountInfo_InvalidOctal(t *testing.T) {
+	// Invalid octal (not 3 digits) should be left as-is
+	input := "/mnt/my\\04data"
+	result := unescapeMountInfo(input)
+	// Should preserve the backslash since it's not a valid 3-digit octal
+	if result != input {
+		t.Errorf("expected %q (unchanged), got %q", input, result)
+	}
+}
+
+func TestUnescapeMountInfo_TrailingBackslash(t *testing.T) {
+	// Backslash at end without enough chars
+	input := "/mnt/data\\"
+	result := unescapeMountInfo(input)
+	if result != input {
+		t.Errorf("expected %q (unchanged), got %q", input, result)
+	}
+}
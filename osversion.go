@@ -0,0 +1,98 @@
+package hostapp
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const HOSTOS_BLOCKS_OS_VERSION = "io.balena.image.os-version"
+
+// osVersionKeys are the os-release fields read as the OS version, in order
+var osVersionKeys = []string{"VERSION_ID", "META_BALENA_VERSION"}
+
+// OSVersion returns the version of the OS the hostapp root ships, from the
+// VERSION_ID or else META_BALENA_VERSION field of its /etc/os-release
+func (c *Container) OSVersion() (string, error) {
+	path, err := c.Path("etc/os-release")
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		fields[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("reading %s: %w", path, err)
+	}
+	for _, key := range osVersionKeys {
+		if fields[key] != "" {
+			return fields[key], nil
+		}
+	}
+	return "", fmt.Errorf("%s: no %s", path, strings.Join(osVersionKeys, " or "))
+}
+
+// FilterByOSVersion removes containers whose os-version label doesn't match
+// osVersion, the version of the hostapp they overlay, or cannot be parsed
+// (see VersionConstraint). Containers without the label always pass. An
+// empty osVersion disables filtering.
+func FilterByOSVersion(containers []Container, osVersion string) []Container {
+	if osVersion == "" {
+		return containers
+	}
+	var filtered []Container
+	for _, c := range containers {
+		labelVal, ok := c.Labels[HOSTOS_BLOCKS_OS_VERSION]
+		if !ok {
+			filtered = append(filtered, c)
+			continue
+		}
+		constraint, err := ParseVersionConstraint(labelVal)
+		if err != nil {
+			log.Printf("Error: dropping container %s: %s label: %v", c.Name, HOSTOS_BLOCKS_OS_VERSION, err)
+			reportDropped(c, fmt.Sprintf("%s label: %v", HOSTOS_BLOCKS_OS_VERSION, err))
+			continue
+		}
+		if !constraint.Matches(osVersion) {
+			log.Printf("Skipping container %s: OS version %q != hostapp %q", c.Name, labelVal, osVersion)
+			reportDropped(c, fmt.Sprintf("OS version %q != hostapp %q", labelVal, osVersion))
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
+
+// SelectOSCompatible is FilterByOSVersion with the version of the hostapp
+// root, that also unmounts dropped containers, like SelectMountable. A
+// hostapp without a known version disables filtering.
+func SelectOSCompatible(containers []Container, root *Container) []Container {
+	osVersion, err := root.OSVersion()
+	if err != nil {
+		log.Printf("Warning: OS version of hostapp %s unknown, not filtering OS blocks by it: %v", root.Name, err)
+		return containers
+	}
+	selected := FilterByOSVersion(containers, osVersion)
+	unmountDropped(containers, selected)
+	return selected
+}
@@ -0,0 +1,76 @@
+package hostapp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOSVersion(t *testing.T) {
+	tests := map[string]string{
+		"NAME=\"balenaOS\"\nVERSION=\"6.0.24+rev1\"\nVERSION_ID=\"6.0.24\"\nMETA_BALENA_VERSION=\"6.0.24\"\n": "6.0.24",
+		"# comment\nVERSION_ID='5.1.20'\n":           "5.1.20",
+		"NAME=balenaOS\nMETA_BALENA_VERSION=5.3.0\n": "5.3.0",
+		"NAME=balenaOS\n":                            "",
+	}
+	for content, want := range tests {
+		c := writeConfigV2(t, "hostapp", nil, nil)
+		c.MountPath = t.TempDir()
+		// os-release is usually a link into /usr/lib
+		lib := filepath.Join(c.MountPath, "usr", "lib")
+		if err := os.MkdirAll(lib, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(c.MountPath, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(lib, "os-release"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("../usr/lib/os-release", filepath.Join(c.MountPath, "etc", "os-release")); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := c.OSVersion()
+		if want == "" {
+			if err == nil {
+				t.Errorf("expected an error without a version, got %q", got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("expected %q, got %q (%v)", want, got, err)
+		}
+	}
+}
+
+func TestFilterByOSVersion(t *testing.T) {
+	reasons := map[string]string{}
+	Dropped = func(c Container, reason string) { reasons[c.Name] = reason }
+	defer func() { Dropped = nil }()
+
+	containers := []Container{
+		makeTestContainer("unlabelled", nil),
+		makeTestContainer("range", map[string]string{HOSTOS_BLOCKS_OS_VERSION: ">=6.0 <7"}),
+		makeTestContainer("old", map[string]string{HOSTOS_BLOCKS_OS_VERSION: "5.*"}),
+		makeTestContainer("malformed", map[string]string{HOSTOS_BLOCKS_OS_VERSION: "latest"}),
+	}
+	var got []string
+	for _, c := range FilterByOSVersion(containers, "6.0.24") {
+		got = append(got, c.Name)
+	}
+	if !reflect.DeepEqual(got, []string{"unlabelled", "range"}) {
+		t.Errorf("unexpected containers kept %v", got)
+	}
+	if reasons["old"] != `OS version "5.*" != hostapp "6.0.24"` {
+		t.Errorf("unexpected drop reason %q", reasons["old"])
+	}
+	if reasons["malformed"] != `io.balena.image.os-version label: invalid version "latest"` {
+		t.Errorf("unexpected drop reason %q", reasons["malformed"])
+	}
+
+	if len(FilterByOSVersion(containers, "")) != len(containers) {
+		t.Errorf("expected an unknown OS version to disable filtering")
+	}
+}
@@ -0,0 +1,161 @@
+package hostapp
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsconfig(2) commands, not wrapped by the pinned golang.org/x/sys
+const (
+	fsconfigSetString = 1
+	fsconfigCmdCreate = 6
+)
+
+var (
+	newMountAPIProbe     sync.Once
+	newMountAPISupported bool
+)
+
+// fsconfig configures the filesystem context fd. An empty key is passed as
+// NULL, as FSCONFIG_CMD_CREATE requires.
+func fsconfig(fd int, cmd int, key string, value string) error {
+	var keyp, valuep *byte
+	var err error
+	if key != "" {
+		if keyp, err = unix.BytePtrFromString(key); err != nil {
+			return err
+		}
+	}
+	if cmd == fsconfigSetString {
+		if valuep, err = unix.BytePtrFromString(value); err != nil {
+			return err
+		}
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_FSCONFIG, uintptr(fd), uintptr(cmd),
+		uintptr(unsafe.Pointer(keyp)), uintptr(unsafe.Pointer(valuep)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// NewMountAPISupported reports whether the running kernel can build overlay
+// mounts through fsopen(2)/fsmount(2), adding lowerdirs one at a time with
+// "lowerdir+" (Linux 6.8+). Those mounts are not bound by the page-size limit
+// on mount options. The kernel is probed once and the result cached.
+func NewMountAPISupported() bool {
+	newMountAPIProbe.Do(func() {
+		fd, err := unix.Fsopen("overlay", unix.FSOPEN_CLOEXEC)
+		if err != nil {
+			return
+		}
+		defer unix.Close(fd)
+		newMountAPISupported = fsconfig(fd, fsconfigSetString, "lowerdir+", "/") == nil
+	})
+	return newMountAPISupported
+}
+
+// OverlayOptionsLimit returns the mount options budget to pass to
+// BuildOverlayLowerDirs: unlimited (0) when the new mount API is available,
+// the kernel page size otherwise.
+func OverlayOptionsLimit() int {
+	if NewMountAPISupported() {
+		return 0
+	}
+	return os.Getpagesize() - 1
+}
+
+// MountOverlay mounts a read-only overlay of lowerDirs, highest precedence
+// first, at target. The new mount API is used when the kernel supports it,
+// falling back to a single lowerdir= options string on older kernels.
+func MountOverlay(target string, lowerDirs []string) error {
+	if NewMountAPISupported() {
+		return mountOverlayFS(target, lowerDirs)
+	}
+	return mountOverlayLegacy(target, lowerDirs)
+}
+
+// MountOverlayFrom is MountOverlay with relative lowerDirs resolved against
+// dir. Like dockerd does for overlay2 short links, the process working
+// directory is switched to dir for the duration of the mount.
+func MountOverlayFrom(dir string, target string, lowerDirs []string) error {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("getting working directory: %w", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("changing to %s: %w", dir, err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			log.Printf("Warning: failed to restore working directory %s: %v", wd, err)
+		}
+	}()
+	return MountOverlay(target, lowerDirs)
+}
+
+// MountReadOnlyBind bind mounts source on target read-only
+func MountReadOnlyBind(source, target string) error {
+	if err := unix.Mount(source, target, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mounting %s: %w", source, err)
+	}
+	if err := unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, ""); err != nil {
+		unix.Unmount(target, unix.MNT_DETACH)
+		return fmt.Errorf("remounting %s read-only: %w", target, err)
+	}
+	return nil
+}
+
+// mountOverlayLegacy mounts the overlay with mount(2), which limits the
+// options string to a page.
+func mountOverlayLegacy(target string, lowerDirs []string) error {
+	opts := "lowerdir=" + strings.Join(lowerDirs, ":")
+	if len(opts) >= os.Getpagesize()-1 {
+		return fmt.Errorf("mount options (%d bytes) exceed page size limit", len(opts))
+	}
+	if err := unix.Mount("overlay", target, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("mounting overlay: %w", err)
+	}
+	return nil
+}
+
+// mountOverlayFS mounts the overlay with fsopen/fsconfig/fsmount/move_mount,
+// passing each lowerdir separately.
+func mountOverlayFS(target string, lowerDirs []string) error {
+	fd, err := unix.Fsopen("overlay", unix.FSOPEN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("fsopen overlay: %w", err)
+	}
+	defer unix.Close(fd)
+
+	for _, dir := range lowerDirs {
+		if err := fsconfig(fd, fsconfigSetString, "lowerdir+", dir); err != nil {
+			return fmt.Errorf("adding lowerdir %s: %w", dir, err)
+		}
+	}
+	if err := fsconfig(fd, fsconfigCmdCreate, "", ""); err != nil {
+		return fmt.Errorf("creating overlay: %w", err)
+	}
+
+	mfd, err := unix.Fsmount(fd, unix.FSMOUNT_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("fsmount overlay: %w", err)
+	}
+	defer unix.Close(mfd)
+
+	if err := unix.MoveMount(mfd, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("moving overlay to %s: %w", target, err)
+	}
+	return nil
+}
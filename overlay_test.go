@@ -0,0 +1,260 @@
+package hostapp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestBuildOverlayLowerDirsUnlimited verifies that a non-positive limit keeps
+// every extension, however long the combined options would be.
+func TestBuildOverlayLowerDirsUnlimited(t *testing.T) {
+	pageSize := os.Getpagesize()
+	left := []Extension{
+		{MountPath: "/" + strings.Repeat("b", pageSize), Name: "second", Priority: 2},
+		{MountPath: "/" + strings.Repeat("a", pageSize), Name: "first", Priority: 1},
+	}
+	right := []Extension{
+		{MountPath: "/" + strings.Repeat("n", pageSize), Name: "right"},
+	}
+
+	got := BuildOverlayLowerDirs("/base", left, right, 0)
+	want := []string{left[0].MountPath, left[1].MountPath, "/base", right[0].MountPath}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected every extension in order, got %d entries", len(got))
+	}
+
+	limited := BuildOverlayLowerDirs("/base", left, right, pageSize-1)
+	if !reflect.DeepEqual(limited, []string{"/base"}) {
+		t.Errorf("expected only /base within a page, got %d entries", len(limited))
+	}
+}
+
+// TestBuildOverlayLowerDirsRequires verifies that an extension is dropped
+// with the extension it requires when that one does not fit, and that the
+// room it leaves is used by others.
+func TestBuildOverlayLowerDirsRequires(t *testing.T) {
+	app := Extension{Name: "/app", MountPath: "/" + strings.Repeat("a", 100), Priority: 1, Requires: []string{"lib", "elsewhere"}}
+	lib := Extension{Name: "/lib", MountPath: "/" + strings.Repeat("l", 200)}
+	// lib only fits without app
+	limit := len("lowerdir=/base:") + len(lib.MountPath) + 1
+
+	got := BuildOverlayLowerDirs("/base", []Extension{app}, []Extension{lib}, limit)
+	if want := []string{"/base", lib.MountPath}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected app to make room for lib, got %v", got)
+	}
+
+	// Without room for lib even alone, app goes with it
+	got = BuildOverlayLowerDirs("/base", []Extension{app}, []Extension{lib}, limit-1)
+	if want := []string{"/base"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected app to be dropped with lib, got %v", got)
+	}
+
+	// Requirements among other extensions are left to ResolveDependencies
+	got = BuildOverlayLowerDirs("/base", []Extension{app}, nil, 0)
+	if want := []string{app.MountPath, "/base"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected app alone to be kept, got %v", got)
+	}
+}
+
+// makeOverlayLayers creates count long-named lower directories, each holding
+// a file named after its index and a "shared" file recording its own path.
+func makeOverlayLayers(t *testing.T, count int) []string {
+	t.Helper()
+	var dirs []string
+	for i := 0; i < count; i++ {
+		dir := filepath.Join(t.TempDir(), strings.Repeat("l", 200))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("layer-%d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "shared"), []byte(dir), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func TestMountOverlay(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to perform overlay mount")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("unshare: %v", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("make mounts private: %v", err)
+	}
+
+	check := func(t *testing.T, target string, lowerDirs []string) {
+		t.Helper()
+		defer unix.Unmount(target, unix.MNT_DETACH)
+		shared, err := os.ReadFile(filepath.Join(target, "shared"))
+		if err != nil {
+			t.Fatalf("reading merged file: %v", err)
+		}
+		if string(shared) != lowerDirs[0] {
+			t.Errorf("expected first lowerdir to take precedence, got %q", shared)
+		}
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) < 2 {
+			t.Errorf("expected merged view of all layers, got %d entries", len(entries))
+		}
+	}
+
+	// No subtests: their goroutines would run outside this thread's namespace.
+	lowerDirs := makeOverlayLayers(t, 3)
+	target := t.TempDir()
+	if err := mountOverlayLegacy(target, lowerDirs); err != nil {
+		t.Fatalf("mountOverlayLegacy: %v", err)
+	}
+	check(t, target, lowerDirs)
+
+	// Enough long lowerdirs to overflow a page of mount options
+	lowerDirs = makeOverlayLayers(t, os.Getpagesize()/200+1)
+	if err := mountOverlayLegacy(t.TempDir(), lowerDirs); err == nil {
+		t.Error("expected page size error from mount(2) path")
+	}
+
+	if !NewMountAPISupported() {
+		t.Skip("kernel lacks fsopen overlay lowerdir+ support")
+	}
+	target = t.TempDir()
+	if err := mountOverlayFS(target, lowerDirs); err != nil {
+		t.Fatalf("mountOverlayFS: %v", err)
+	}
+	check(t, target, lowerDirs)
+}
+
+func TestBuildFlatLowerDirs(t *testing.T) {
+	base := []string{"/h0", "/h1"}
+	left := []Extension{
+		{Name: "late", Priority: 20, LowerDirs: []string{"/o2a", "/o2b"}},
+		{Name: "early", Priority: 10, LowerDirs: []string{"/o1a"}},
+	}
+	right := []Extension{
+		{Name: "extras", LowerDirs: []string{"/n1a", "/n1b"}},
+		{Name: "more", LowerDirs: []string{"/n2"}},
+		// No layers of its own: its overlay mount is not stacked
+		{Name: "empty", MountPath: "/n3"},
+	}
+
+	got := BuildFlatLowerDirs(base, left, right, 0)
+	want := []string{"/o1a", "/o2a", "/o2b", "/h0", "/h1", "/n1a", "/n1b", "/n2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// Extensions are dropped as a whole: "extras" does not fit, "more" is
+	// never considered after it
+	limit := len("lowerdir=/o1a:/o2a:/o2b:/h0:/h1:/n1a") + 1
+	got = BuildFlatLowerDirs(base, left, right, limit)
+	want = []string{"/o1a", "/o2a", "/o2b", "/h0", "/h1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("with limit expected %v, got %v", want, got)
+	}
+}
+
+func TestLayerLowerDir(t *testing.T) {
+	layer := Layer{ID: "abc", Link: "l/SHORT", DiffPath: "/data/docker/overlay2/abc/diff"}
+	tests := []struct {
+		name string
+		dir  string
+		want string
+	}{
+		{"own overlay2 directory", "/data/docker/overlay2", "l/SHORT"},
+		{"own overlay2 directory unclean", "/data/docker/overlay2/", "l/SHORT"},
+		{"nearby directory", "/data/docker/other", "../overlay2/l/SHORT"},
+		{"distant directory", "/a/b/c/d/e/f/g/h/i/j", "/data/docker/overlay2/l/SHORT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := layer.LowerDir(tt.dir); got != tt.want {
+				t.Errorf("LowerDir(%q) = %q, want %q", tt.dir, got, tt.want)
+			}
+		})
+	}
+
+	noLink := Layer{ID: "abc", Link: "/data/docker/overlay2/abc/diff", DiffPath: "/data/docker/overlay2/abc/diff"}
+	if got := noLink.LowerDir("/data/docker/overlay2"); got != "abc/diff" {
+		t.Errorf("expected relative diff path, got %q", got)
+	}
+}
+
+// TestFlatOverlay mounts a hostapp and an override extension kept in
+// different storage roots as one overlay of their layers.
+func TestFlatOverlay(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to perform overlay mount")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("unshare: %v", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("make mounts private: %v", err)
+	}
+
+	hostRoot := t.TempDir()
+	dataRoot := t.TempDir()
+	writeOverlay2Container(t, hostRoot, "hostapp", nil, []map[string]string{
+		{"etc/issue": "hostapp"}, {"bin/sh": "sh"},
+	})
+	writeOverlay2Container(t, dataRoot, "block", map[string]string{HOSTOS_BLOCKS_OVERRIDE: "1"}, []map[string]string{
+		{"etc/issue": "block"}, {"usr/lib/block": "lib"},
+	})
+
+	host, err := MountID(hostRoot, "cid-hostapp")
+	if err != nil {
+		t.Fatalf("mounting hostapp: %v", err)
+	}
+	defer unix.Unmount(host.MountPath, unix.MNT_DETACH)
+	block, err := MountID(dataRoot, "cid-block")
+	if err != nil {
+		t.Fatalf("mounting extension: %v", err)
+	}
+	defer unix.Unmount(block.MountPath, unix.MNT_DETACH)
+
+	mountDir := filepath.Join(dataRoot, "overlay2")
+	var base, blockDirs []string
+	for _, l := range host.Layers {
+		base = append(base, l.LowerDir(mountDir))
+	}
+	for _, l := range block.Layers {
+		blockDirs = append(blockDirs, l.LowerDir(mountDir))
+	}
+	lowerDirs := BuildFlatLowerDirs(base, []Extension{{Name: "block", Priority: 1, LowerDirs: blockDirs}}, nil, OverlayOptionsLimit())
+	if len(lowerDirs) != 4 {
+		t.Fatalf("expected 4 layers, got %v", lowerDirs)
+	}
+
+	target := t.TempDir()
+	if err := MountOverlayFrom(mountDir, target, lowerDirs); err != nil {
+		t.Fatalf("MountOverlayFrom: %v", err)
+	}
+	defer unix.Unmount(target, unix.MNT_DETACH)
+
+	if content, _ := os.ReadFile(filepath.Join(target, "etc", "issue")); string(content) != "block" {
+		t.Errorf("expected override layer to win, got %q", content)
+	}
+	for _, path := range []string{"bin/sh", "usr/lib/block"} {
+		if _, err := os.Stat(filepath.Join(target, path)); err != nil {
+			t.Errorf("expected %s in flat overlay: %v", path, err)
+		}
+	}
+}
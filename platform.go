@@ -0,0 +1,147 @@
+package hostapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const HOSTOS_BLOCKS_DEVICE_TYPE = "io.balena.image.device-type"
+
+// Platform is the architecture an image was built for, as recorded in its
+// config. Both fields are empty when unknown.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	// Variant is the CPU variant, e.g. "v7" for arm
+	Variant string `json:"variant"`
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.Architecture
+	}
+	return p.Architecture + "/" + p.Variant
+}
+
+// normalize drops the variant arm64 images carry or not interchangeably
+func (p Platform) normalize() Platform {
+	if p.Architecture == "arm64" && p.Variant == "v8" {
+		p.Variant = ""
+	}
+	return p
+}
+
+// Matches tells whether an image built for p runs on host. The variant is
+// only compared when both sides record one.
+func (p Platform) Matches(host Platform) bool {
+	p, host = p.normalize(), host.normalize()
+	if p.Architecture != host.Architecture {
+		return false
+	}
+	return p.Variant == "" || host.Variant == "" || p.Variant == host.Variant
+}
+
+// Host is what OS blocks are matched against besides the kernel: the
+// hostapp image's platform and the device type of the board. An empty field
+// is unknown and disables its filter.
+type Host struct {
+	Platform
+	DeviceType string
+}
+
+// dockerImagePlatform reads the platform of image, an image ID as recorded
+// in a container config, from rootdir's overlay2 imagedb. Images the imagedb
+// does not hold, e.g. with the containerd image store, have no known
+// platform.
+func dockerImagePlatform(rootdir, image string) Platform {
+	id, ok := strings.CutPrefix(image, "sha256:")
+	if !ok {
+		return Platform{}
+	}
+	configPath := filepath.Join(rootdir, "image", "overlay2", "imagedb", "content", "sha256", id)
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		if Debug {
+			log.Printf("No platform for image %s: %v", image, err)
+		}
+		return Platform{}
+	}
+	var config dockerImageConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		log.Printf("Error decoding %s: %v", configPath, err)
+		return Platform{}
+	}
+	return config.Platform
+}
+
+// FilterByPlatform removes containers built for a platform other than
+// host's (see Platform.Matches). Containers of unknown platform always pass,
+// and an unknown host platform disables filtering.
+func FilterByPlatform(containers []Container, host Platform) []Container {
+	if host.Architecture == "" {
+		return containers
+	}
+	var filtered []Container
+	for _, c := range containers {
+		if c.Platform.Architecture != "" && !c.Platform.Matches(host) {
+			log.Printf("Skipping container %s: architecture %s != hostapp %s", c.Name, c.Platform, host)
+			reportDropped(c, fmt.Sprintf("architecture %s != hostapp %s", c.Platform, host))
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
+
+// FilterByDeviceType removes containers whose device-type label, a comma
+// separated list of device type slugs, does not list deviceType. Containers
+// without the label always pass, and an empty deviceType disables filtering.
+func FilterByDeviceType(containers []Container, deviceType string) []Container {
+	if deviceType == "" {
+		return containers
+	}
+	var filtered []Container
+	for _, c := range containers {
+		labelVal, ok := c.Labels[HOSTOS_BLOCKS_DEVICE_TYPE]
+		if !ok {
+			filtered = append(filtered, c)
+			continue
+		}
+		matched := false
+		for _, slug := range labelNames(c, HOSTOS_BLOCKS_DEVICE_TYPE) {
+			if slug == deviceType {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			log.Printf("Skipping container %s: device type %q != device %q", c.Name, labelVal, deviceType)
+			reportDropped(c, fmt.Sprintf("device type %q != device %q", labelVal, deviceType))
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
+
+// ReadDeviceType returns the slug of the device-type.json at path, as found
+// on the boot partition
+func ReadDeviceType(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var deviceType struct {
+		Slug string `json:"slug"`
+	}
+	if err := json.Unmarshal(content, &deviceType); err != nil {
+		return "", fmt.Errorf("decoding %s: %w", path, err)
+	}
+	if deviceType.Slug == "" {
+		return "", fmt.Errorf("%s: no slug", path)
+	}
+	return deviceType.Slug, nil
+}
@@ -0,0 +1,119 @@
+package hostapp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlatformMatches(t *testing.T) {
+	tests := []struct {
+		image, host Platform
+		want        bool
+	}{
+		{Platform{"arm64", ""}, Platform{"arm64", ""}, true},
+		{Platform{"arm64", "v8"}, Platform{"arm64", ""}, true},
+		{Platform{"arm", "v7"}, Platform{"arm", "v7"}, true},
+		{Platform{"arm", ""}, Platform{"arm", "v7"}, true},
+		{Platform{"arm", "v6"}, Platform{"arm", "v7"}, false},
+		{Platform{"arm64", ""}, Platform{"arm", "v7"}, false},
+		{Platform{"amd64", ""}, Platform{"arm64", ""}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.image.Matches(tt.host); got != tt.want {
+			t.Errorf("%s on %s: expected %v, got %v", tt.image, tt.host, tt.want, got)
+		}
+	}
+}
+
+func TestFilterByPlatform(t *testing.T) {
+	reasons := map[string]string{}
+	Dropped = func(c Container, reason string) { reasons[c.Name] = reason }
+	defer func() { Dropped = nil }()
+
+	unknown := makeTestContainer("unknown", nil)
+	armv7 := makeTestContainer("armv7", nil)
+	armv7.Platform = Platform{"arm", "v7"}
+	aarch64 := makeTestContainer("aarch64", nil)
+	aarch64.Platform = Platform{"arm64", "v8"}
+	containers := []Container{unknown, armv7, aarch64}
+
+	var got []string
+	for _, c := range FilterByPlatform(containers, Platform{"arm", "v7"}) {
+		got = append(got, c.Name)
+	}
+	if !reflect.DeepEqual(got, []string{"unknown", "armv7"}) {
+		t.Errorf("unexpected containers kept %v", got)
+	}
+	if reasons["aarch64"] != "architecture arm64/v8 != hostapp arm/v7" {
+		t.Errorf("unexpected drop reason %q", reasons["aarch64"])
+	}
+
+	if len(FilterByPlatform(containers, Platform{})) != len(containers) {
+		t.Errorf("expected an unknown host platform to disable filtering")
+	}
+}
+
+func TestFilterByDeviceType(t *testing.T) {
+	reasons := map[string]string{}
+	Dropped = func(c Container, reason string) { reasons[c.Name] = reason }
+	defer func() { Dropped = nil }()
+
+	containers := []Container{
+		makeTestContainer("unlabelled", nil),
+		makeTestContainer("rpi", map[string]string{HOSTOS_BLOCKS_DEVICE_TYPE: "raspberrypi3-64, raspberrypi4-64"}),
+		makeTestContainer("jetson", map[string]string{HOSTOS_BLOCKS_DEVICE_TYPE: "jetson-orin-nano-devkit-nvme"}),
+	}
+	var got []string
+	for _, c := range FilterByDeviceType(containers, "raspberrypi4-64") {
+		got = append(got, c.Name)
+	}
+	if !reflect.DeepEqual(got, []string{"unlabelled", "rpi"}) {
+		t.Errorf("unexpected containers kept %v", got)
+	}
+	if reasons["jetson"] != `device type "jetson-orin-nano-devkit-nvme" != device "raspberrypi4-64"` {
+		t.Errorf("unexpected drop reason %q", reasons["jetson"])
+	}
+
+	if len(FilterByDeviceType(containers, "")) != len(containers) {
+		t.Errorf("expected an unknown device type to disable filtering")
+	}
+}
+
+func TestReadDeviceType(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "device-type.json")
+	if err := os.WriteFile(path, []byte(`{"slug": "raspberrypi4-64", "arch": "aarch64"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if slug, err := ReadDeviceType(path); err != nil || slug != "raspberrypi4-64" {
+		t.Errorf("expected raspberrypi4-64, got %q (%v)", slug, err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"arch": "aarch64"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadDeviceType(path); err == nil {
+		t.Errorf("expected an error without a slug")
+	}
+}
+
+func TestDockerImagePlatform(t *testing.T) {
+	root := t.TempDir()
+	contentDir := filepath.Join(root, "image", "overlay2", "imagedb", "content", "sha256")
+	if err := os.MkdirAll(contentDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := `{"architecture": "arm", "variant": "v7", "os": "linux", "config": {}}`
+	if err := os.WriteFile(filepath.Join(contentDir, "abc"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := dockerImagePlatform(root, "sha256:abc"); got != (Platform{"arm", "v7"}) {
+		t.Errorf("expected arm/v7, got %q", got)
+	}
+	if got := dockerImagePlatform(root, "sha256:missing"); got != (Platform{}) {
+		t.Errorf("expected an unknown platform for a missing image, got %q", got)
+	}
+}
@@ -0,0 +1,144 @@
+package hostapp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errPolicyViolation stops the walk of a layer at the first violation
+var errPolicyViolation = errors.New("content policy violation")
+
+// ContentPolicy restricts what OS blocks may hold.
+// Whiteouts and opaque directories are always forbidden in normal (not
+// override) OS blocks, which may only add files under the hostapp's.
+type ContentPolicy struct {
+	// NoSpecialFiles forbids setuid and setgid files and device nodes in
+	// every OS block
+	NoSpecialFiles bool
+	// Flat checks OS blocks for a flat overlay (see BuildFlatLowerDirs),
+	// where whiteouts and opaque directories act across images: override
+	// blocks may not hold any either, and normal blocks may not hold files
+	// the hostapp's whiteouts and opaque directories hide
+	Flat bool
+}
+
+// Check walks the layers the OS block c adds to root (see OwnLayers), and
+// returns the first file it holds that the policy forbids
+func (p ContentPolicy) Check(c *Container, root *Container) error {
+	_, override := c.Labels[HOSTOS_BLOCKS_OVERRIDE]
+	if override && !p.NoSpecialFiles && !p.Flat {
+		return nil
+	}
+	// Whether a whiteout or opaque directory can delete files
+	deletes := !override || p.Flat
+	var hidden func(string) string
+	if p.Flat && !override {
+		hidden = hiddenBy(root.Layers)
+	}
+	for _, layer := range c.OwnLayers(root) {
+		var violation string
+		err := filepath.WalkDir(layer.DiffPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel := "/" + strings.TrimPrefix(path[len(layer.DiffPath):], "/")
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			switch {
+			case deletes && (isWhiteout(fi) || strings.HasPrefix(d.Name(), whiteoutPrefix)):
+				violation = "whiteout " + rel
+			case deletes && fi.IsDir() && isOpaque(path):
+				violation = "opaque directory " + rel
+			case hidden != nil && rel != "/" && hidden(rel) != "":
+				violation = rel + " hidden by " + hidden(rel)
+			case p.NoSpecialFiles && fi.Mode().IsRegular() && fi.Mode()&fs.ModeSetuid != 0:
+				violation = "setuid file " + rel
+			case p.NoSpecialFiles && fi.Mode().IsRegular() && fi.Mode()&fs.ModeSetgid != 0:
+				violation = "setgid file " + rel
+			case p.NoSpecialFiles && fi.Mode()&fs.ModeDevice != 0 && !isWhiteout(fi):
+				violation = "device node " + rel
+			default:
+				return nil
+			}
+			return errPolicyViolation
+		})
+		if errors.Is(err, errPolicyViolation) {
+			return fmt.Errorf("%s in layer %s", violation, layer.ID)
+		} else if err != nil {
+			return fmt.Errorf("walking layer %s: %w", layer.ID, err)
+		}
+	}
+	return nil
+}
+
+// hiddenBy returns a function telling what in layers, stacked above others
+// in a flat overlay, hides path there: a whiteout on it or one of its
+// parents, or an opaque parent directory. Returns "" if nothing does.
+func hiddenBy(layers []Layer) func(path string) string {
+	type hider struct{ whiteout, opaque string }
+	cache := make(map[string]hider)
+	lookup := func(path string) hider {
+		if h, ok := cache[path]; ok {
+			return h
+		}
+		var h hider
+		for _, layer := range layers {
+			full := filepath.Join(layer.DiffPath, path)
+			fi, err := os.Lstat(full)
+			if err != nil {
+				continue
+			}
+			if isWhiteout(fi) {
+				h.whiteout = fmt.Sprintf("whiteout %s in hostapp layer %s", path, layer.ID)
+				break
+			}
+			if !fi.IsDir() {
+				// Hides what is below in stacked overlays too
+				break
+			}
+			if isOpaque(full) {
+				h.opaque = fmt.Sprintf("opaque directory %s in hostapp layer %s", path, layer.ID)
+				break
+			}
+		}
+		cache[path] = h
+		return h
+	}
+	return func(path string) string {
+		parents := splitPath(path)
+		for i := range parents {
+			h := lookup("/" + strings.Join(parents[:i+1], "/"))
+			if h.whiteout != "" {
+				return h.whiteout
+			}
+			if i < len(parents)-1 && h.opaque != "" {
+				return h.opaque
+			}
+		}
+		return ""
+	}
+}
+
+// SelectPermitted drops the OS blocks holding files policy forbids,
+// unmounting them like SelectMountable
+func SelectPermitted(containers []Container, root *Container, policy ContentPolicy) []Container {
+	var selected []Container
+	for i := range containers {
+		c := &containers[i]
+		if err := policy.Check(c, root); err != nil {
+			log.Printf("Error: dropping container %s: content policy: %v", c.Name, err)
+			reportDropped(*c, fmt.Sprintf("content policy: %v", err))
+			continue
+		}
+		selected = append(selected, *c)
+	}
+	unmountDropped(containers, selected)
+	return selected
+}
@@ -0,0 +1,166 @@
+package hostapp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestContentPolicy(t *testing.T) {
+	setuid := writeShadowLayer(t, "setuid", map[string]string{"usr/bin/tool": "#!/bin/sh"})
+	if err := os.Chmod(filepath.Join(setuid.DiffPath, "usr/bin/tool"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	setgidDir := writeShadowLayer(t, "setgid-dir", map[string]string{"var/lib/shared/": ""})
+	if err := os.Chmod(filepath.Join(setgidDir.DiffPath, "var/lib/shared"), 0755|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	aufsWhiteout := writeShadowLayer(t, "aufs-whiteout", map[string]string{"etc/.wh.issue": ""})
+
+	root := Container{Layers: []Layer{writeShadowLayer(t, "hostapp", nil)}}
+	block := func(name string, override bool, layers ...Layer) *Container {
+		labels := map[string]string{}
+		if override {
+			labels[HOSTOS_BLOCKS_OVERRIDE] = "1"
+		}
+		c := makeTestContainer(name, labels)
+		c.Layers = layers
+		return &c
+	}
+	// The hostapp's own setuid files are not the OS block's
+	shared := Container{Layers: []Layer{setuid}}
+
+	tests := []struct {
+		name   string
+		c      *Container
+		policy ContentPolicy
+		want   string
+	}{
+		{"normal block whiteout", block("normal", false, aufsWhiteout), ContentPolicy{}, "whiteout /etc/.wh.issue in layer aufs-whiteout"},
+		{"override block whiteout", block("override", true, aufsWhiteout), ContentPolicy{}, ""},
+		{"override block whiteout flat", block("override", true, aufsWhiteout), ContentPolicy{Flat: true}, "whiteout /etc/.wh.issue in layer aufs-whiteout"},
+		{"setuid allowed by default", block("normal", false, setuid), ContentPolicy{}, ""},
+		{"setuid forbidden", block("override", true, setuid), ContentPolicy{NoSpecialFiles: true}, "setuid file /usr/bin/tool in layer setuid"},
+		{"setgid directory", block("normal", false, setgidDir), ContentPolicy{NoSpecialFiles: true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.c, &root)
+			if tt.want == "" && err != nil {
+				t.Errorf("expected no violation, got %v", err)
+			} else if tt.want != "" && (err == nil || err.Error() != tt.want) {
+				t.Errorf("expected %q, got %v", tt.want, err)
+			}
+		})
+	}
+	if err := (ContentPolicy{NoSpecialFiles: true}).Check(block("normal", false, setuid), &shared); err != nil {
+		t.Errorf("expected layers shared with the hostapp to be left out, got %v", err)
+	}
+}
+
+func TestContentPolicySpecialFiles(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to create whiteouts, opaque directories and device nodes")
+	}
+
+	device := writeShadowLayer(t, "device", nil)
+	if err := unix.Mknod(filepath.Join(device.DiffPath, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+		t.Fatal(err)
+	}
+	root := Container{}
+	normal := makeTestContainer("normal", nil)
+	override := makeTestContainer("override", map[string]string{HOSTOS_BLOCKS_OVERRIDE: "1"})
+
+	normal.Layers = []Layer{writeShadowLayer(t, "whiteout", map[string]string{"etc/issue": "whiteout"})}
+	if err := (ContentPolicy{}).Check(&normal, &root); err == nil || err.Error() != "whiteout /etc/issue in layer whiteout" {
+		t.Errorf("expected a whiteout violation, got %v", err)
+	}
+	// An override block's whiteouts are no device nodes
+	override.Layers = normal.Layers
+	if err := (ContentPolicy{NoSpecialFiles: true}).Check(&override, &root); err != nil {
+		t.Errorf("expected no violation, got %v", err)
+	}
+
+	normal.Layers = []Layer{writeShadowLayer(t, "opaque", map[string]string{"opt/vendor": "opaque"})}
+	if err := (ContentPolicy{}).Check(&normal, &root); err == nil || err.Error() != "opaque directory /opt/vendor in layer opaque" {
+		t.Errorf("expected an opaque directory violation, got %v", err)
+	}
+
+	override.Layers = []Layer{device}
+	if err := (ContentPolicy{}).Check(&override, &root); err != nil {
+		t.Errorf("expected device nodes to be allowed by default, got %v", err)
+	}
+	if err := (ContentPolicy{NoSpecialFiles: true}).Check(&override, &root); err == nil || err.Error() != "device node /null in layer device" {
+		t.Errorf("expected a device node violation, got %v", err)
+	}
+}
+
+func TestContentPolicyFlat(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to create whiteouts and opaque directories")
+	}
+
+	root := Container{Layers: []Layer{
+		writeShadowLayer(t, "hostapp-top", map[string]string{"etc/issue": "whiteout", "usr/": ""}),
+		writeShadowLayer(t, "hostapp-base", map[string]string{"opt/vendor": "opaque", "usr/share/doc": "whiteout"}),
+	}}
+	normal := makeTestContainer("normal", nil)
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"whited out file", map[string]string{"etc/issue": "extension"}, "/etc/issue hidden by whiteout /etc/issue in hostapp layer hostapp-top in layer block"},
+		{"under opaque directory", map[string]string{"opt/vendor/tool": "tool"}, "/opt/vendor/tool hidden by opaque directory /opt/vendor in hostapp layer hostapp-base in layer block"},
+		{"under lower whiteout", map[string]string{"usr/share/doc/README": "doc"}, "/usr/share/doc hidden by whiteout /usr/share/doc in hostapp layer hostapp-base in layer block"},
+		{"opaque directory itself", map[string]string{"opt/vendor/": ""}, ""},
+		{"visible", map[string]string{"etc/motd": "hello", "usr/bin/tool": "tool"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			normal.Layers = []Layer{writeShadowLayer(t, "block", tt.files)}
+			if err := (ContentPolicy{}).Check(&normal, &root); err != nil {
+				t.Errorf("expected stacked overlays to allow it, got %v", err)
+			}
+			err := (ContentPolicy{Flat: true}).Check(&normal, &root)
+			if tt.want == "" && err != nil {
+				t.Errorf("expected no violation, got %v", err)
+			} else if tt.want != "" && (err == nil || err.Error() != tt.want) {
+				t.Errorf("expected %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	// An override block's whiteouts would delete hostapp files
+	override := makeTestContainer("override", map[string]string{HOSTOS_BLOCKS_OVERRIDE: "1"})
+	override.Layers = []Layer{writeShadowLayer(t, "override", map[string]string{"etc/hostname": "whiteout"})}
+	if err := (ContentPolicy{}).Check(&override, &root); err != nil {
+		t.Errorf("expected stacked overlays to allow it, got %v", err)
+	}
+	if err := (ContentPolicy{Flat: true}).Check(&override, &root); err == nil || err.Error() != "whiteout /etc/hostname in layer override" {
+		t.Errorf("expected a whiteout violation, got %v", err)
+	}
+}
+
+func TestSelectPermitted(t *testing.T) {
+	reasons := map[string]string{}
+	Dropped = func(c Container, reason string) { reasons[c.Name] = reason }
+	defer func() { Dropped = nil }()
+
+	clean := makeTestContainer("clean", nil)
+	clean.Layers = []Layer{writeShadowLayer(t, "clean", map[string]string{"usr/bin/tool": "tool"})}
+	whiteout := makeTestContainer("whiteout", nil)
+	whiteout.Layers = []Layer{writeShadowLayer(t, "whiteout", map[string]string{"etc/.wh.issue": ""})}
+
+	selected := SelectPermitted([]Container{clean, whiteout}, &Container{}, ContentPolicy{})
+	if len(selected) != 1 || selected[0].Name != "clean" {
+		t.Errorf("expected only clean to be kept, got %+v", selected)
+	}
+	if !strings.HasPrefix(reasons["whiteout"], "content policy: whiteout /etc/.wh.issue") {
+		t.Errorf("unexpected drop reason %q", reasons["whiteout"])
+	}
+}
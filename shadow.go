@@ -0,0 +1,206 @@
+package hostapp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extended attributes marking an overlayfs opaque directory, as set by the
+// kernel and by engines mounting with or without userxattr
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// StackImage is one image of an overlay stack: the hostapp or an OS block
+type StackImage struct {
+	Name string
+	// Layers are the image's layers in the stack, top first
+	Layers []Layer
+}
+
+// ShadowLayer is an image layer's copy of a path
+type ShadowLayer struct {
+	Image string `json:"image"`
+	Layer string `json:"layer"`
+}
+
+// Shadow is a path one image of an overlay stack provides over the copies of
+// other images below it
+type Shadow struct {
+	Path     string      `json:"path"`
+	Provider ShadowLayer `json:"provider"`
+	// Whiteout is set when the provider deletes the path
+	Whiteout bool `json:"whiteout,omitempty"`
+	// Opaque is set when the provider is an opaque directory, which hides
+	// the contents of the directories below it
+	Opaque  bool          `json:"opaque,omitempty"`
+	Shadows []ShadowLayer `json:"shadows"`
+}
+
+// shadowLayer is a layer of the stack, with the overlay its whiteouts and
+// opaque directories apply to
+type shadowLayer struct {
+	image   string
+	layer   Layer
+	overlay int
+}
+
+// shadowEntry is a layer's copy of a path
+type shadowEntry struct {
+	layer                 *shadowLayer
+	dir, opaque, whiteout bool
+}
+
+// ShadowReport walks the layer diffs of an overlay stack, highest precedence
+// image first, and returns the paths where one image hides the copy of
+// another, sorted by path. Copies in the same layer, as images sharing base
+// layers have, are not shadowing. Directories merge and only shadow what is
+// not a directory, unless they are opaque; contents of hidden directories are
+// not listed.
+//
+// In a flat overlay (see BuildFlatLowerDirs) all layers make a single
+// overlay, so an image's whiteouts and opaque directories also hide the
+// images below it. Otherwise each image is an overlay of its own, in which
+// they only apply to the image's own layers.
+func ShadowReport(stack []StackImage, flat bool) ([]Shadow, error) {
+	var layers []*shadowLayer
+	for i, image := range stack {
+		overlay := i
+		if flat {
+			overlay = 0
+		}
+		for _, layer := range image.Layers {
+			layers = append(layers, &shadowLayer{image: image.Name, layer: layer, overlay: overlay})
+		}
+	}
+	var shadows []Shadow
+	if err := walkShadows("/", layers, flat, &shadows); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(shadows, func(i, j int) bool { return shadows[i].Path < shadows[j].Path })
+	return shadows, nil
+}
+
+// walkShadows merges the directory rel of layers, which all hold it as a
+// visible directory, recording what shadows what in it and in the
+// directories it merges
+func walkShadows(rel string, layers []*shadowLayer, flat bool, shadows *[]Shadow) error {
+	var names []string
+	entries := make(map[string][]shadowEntry)
+	for _, layer := range layers {
+		dir := filepath.Join(layer.layer.DiffPath, rel)
+		dirEntries, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", dir, err)
+		}
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			path := filepath.Join(dir, name)
+			fi, err := os.Lstat(path)
+			if err != nil {
+				return err
+			}
+			entry := shadowEntry{layer: layer, dir: fi.IsDir(), whiteout: isWhiteout(fi)}
+			if entry.dir {
+				entry.opaque = isOpaque(path)
+			}
+			if _, ok := entries[name]; !ok {
+				names = append(names, name)
+			}
+			entries[name] = append(entries[name], entry)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(rel, name)
+		var provider *shadowEntry
+		var merged []*shadowLayer
+		// hiders record what hides the lower copies of each overlay, closer
+		// what hides every lower copy
+		hiders := make(map[int]*shadowEntry)
+		var closer *shadowEntry
+		var hiderOrder []*shadowEntry
+		hidden := make(map[*shadowEntry][]shadowEntry)
+		hide := func(hider *shadowEntry, e shadowEntry) {
+			if _, ok := hidden[hider]; !ok {
+				hiderOrder = append(hiderOrder, hider)
+			}
+			hidden[hider] = append(hidden[hider], e)
+		}
+
+		for i := range entries[name] {
+			e := &entries[name][i]
+			if hider := hiders[e.layer.overlay]; closer != nil || hider != nil {
+				if closer != nil {
+					hider = closer
+				}
+				hide(hider, *e)
+				continue
+			}
+			switch {
+			case e.whiteout:
+				hiders[e.layer.overlay] = e
+				if flat && provider == nil {
+					provider = e
+				}
+			case !e.dir:
+				if provider != nil {
+					// A directory above hides it, and the rest of its overlay
+					hide(provider, *e)
+					hiders[e.layer.overlay] = provider
+					continue
+				}
+				provider, closer = e, e
+			default:
+				if provider == nil {
+					provider = e
+				}
+				merged = append(merged, e.layer)
+				if e.opaque {
+					hiders[e.layer.overlay] = e
+				}
+			}
+		}
+
+		for _, hider := range hiderOrder {
+			shadow := Shadow{
+				Path:     path,
+				Provider: ShadowLayer{Image: hider.layer.image, Layer: hider.layer.layer.ID},
+				Whiteout: hider.whiteout,
+				Opaque:   hider.opaque,
+			}
+			for _, e := range hidden[hider] {
+				// A hidden whiteout deletes nothing
+				if e.whiteout || e.layer.image == hider.layer.image || e.layer.layer.ID == hider.layer.layer.ID {
+					continue
+				}
+				shadow.Shadows = append(shadow.Shadows, ShadowLayer{Image: e.layer.image, Layer: e.layer.layer.ID})
+			}
+			if len(shadow.Shadows) > 0 {
+				*shadows = append(*shadows, shadow)
+			}
+		}
+
+		if provider != nil && provider.dir {
+			if err := walkShadows(path, merged, flat, shadows); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isOpaque tells whether the directory at path is an overlayfs opaque
+// directory
+func isOpaque(path string) bool {
+	value := make([]byte, 1)
+	for _, attr := range opaqueXattrs {
+		if n, err := unix.Lgetxattr(path, attr, value); err == nil && n == 1 && value[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
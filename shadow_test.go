@@ -0,0 +1,139 @@
+package hostapp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// writeShadowLayer creates a layer holding files, where a name ending in
+// "/" is a directory, and a value of "whiteout" or "opaque" makes an
+// overlayfs whiteout or opaque directory
+func writeShadowLayer(t *testing.T, id string, files map[string]string) Layer {
+	t.Helper()
+	diff := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(diff, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case content == "whiteout":
+			if err := unix.Mknod(path, unix.S_IFCHR, 0); err != nil {
+				t.Fatal(err)
+			}
+		case content == "opaque":
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := unix.Setxattr(path, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+				t.Fatal(err)
+			}
+		case name[len(name)-1] == '/':
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return Layer{ID: id, DiffPath: diff}
+}
+
+func TestShadowReport(t *testing.T) {
+	base := writeShadowLayer(t, "base", map[string]string{
+		"etc/issue":    "balenaOS",
+		"etc/hostname": "balena",
+		"usr/bin/tool": "v1",
+		"usr/lib/x":    "x",
+	})
+	stack := []StackImage{
+		{Name: "override", Layers: []Layer{
+			writeShadowLayer(t, "override-top", map[string]string{
+				"etc/issue":      "custom",
+				"etc/motd":       "hello",
+				"usr/lib/":       "",
+				"usr/bin/tool/":  "",
+				"usr/bin/helper": "h",
+			}),
+			// Built from the hostapp: its shared base layer shadows nothing
+			base,
+		}},
+		{Name: "hostapp", Layers: []Layer{
+			writeShadowLayer(t, "hostapp-top", map[string]string{"etc/hostname": "device"}),
+			base,
+		}},
+		{Name: "extension", Layers: []Layer{
+			writeShadowLayer(t, "extension-top", map[string]string{
+				"etc/hostname":  "ext",
+				"usr/bin/other": "o",
+			}),
+		}},
+	}
+
+	shadows, err := ShadowReport(stack, false)
+	if err != nil {
+		t.Fatalf("ShadowReport: %v", err)
+	}
+	want := []Shadow{
+		{Path: "/etc/hostname", Provider: ShadowLayer{"override", "base"}, Shadows: []ShadowLayer{
+			{"hostapp", "hostapp-top"}, {"extension", "extension-top"},
+		}},
+		{Path: "/etc/issue", Provider: ShadowLayer{"override", "override-top"}, Shadows: []ShadowLayer{
+			{"hostapp", "base"},
+		}},
+		{Path: "/usr/bin/tool", Provider: ShadowLayer{"override", "override-top"}, Shadows: []ShadowLayer{
+			{"hostapp", "base"},
+		}},
+	}
+	if !reflect.DeepEqual(shadows, want) {
+		t.Errorf("expected %+v, got %+v", want, shadows)
+	}
+}
+
+func TestShadowReportWhiteouts(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to create whiteouts and opaque directories")
+	}
+
+	image := func(name string, files map[string]string) StackImage {
+		return StackImage{Name: name, Layers: []Layer{writeShadowLayer(t, name+"-layer", files)}}
+	}
+	stack := []StackImage{
+		image("override", map[string]string{
+			"etc/issue":      "whiteout",
+			"opt/vendor":     "opaque",
+			"opt/vendor/new": "n",
+		}),
+		image("hostapp", map[string]string{
+			"etc/issue":      "balenaOS",
+			"opt/vendor/old": "o",
+		}),
+	}
+
+	shadows, err := ShadowReport(stack, true)
+	if err != nil {
+		t.Fatalf("ShadowReport: %v", err)
+	}
+	want := []Shadow{
+		{Path: "/etc/issue", Provider: ShadowLayer{"override", "override-layer"}, Whiteout: true, Shadows: []ShadowLayer{
+			{"hostapp", "hostapp-layer"},
+		}},
+		{Path: "/opt/vendor", Provider: ShadowLayer{"override", "override-layer"}, Opaque: true, Shadows: []ShadowLayer{
+			{"hostapp", "hostapp-layer"},
+		}},
+	}
+	if !reflect.DeepEqual(shadows, want) {
+		t.Errorf("flat: expected %+v, got %+v", want, shadows)
+	}
+
+	// Stacked, each image is an overlay of its own and hides nothing below
+	if shadows, err = ShadowReport(stack, false); err != nil || len(shadows) != 0 {
+		t.Errorf("stacked: expected no shadows, got %+v (%v)", shadows, err)
+	}
+}
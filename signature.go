@@ -0,0 +1,171 @@
+package hostapp
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	HOSTOS_BLOCKS_LABEL_PREFIX = "io.balena.image."
+	HOSTOS_BLOCKS_SIGNATURE    = "io.balena.image.signature"
+	// SIGNATURE_FILE is a detached signature in the container's home directory
+	SIGNATURE_FILE = "signature"
+	// signaturePayloadVersion is the first line of the signed payload
+	signaturePayloadVersion = "mobynit-extension-v1"
+)
+
+// LoadPublicKeys reads the ed25519 public keys, PEM-encoded PKIX "PUBLIC KEY"
+// blocks, from the files in dirs. Directories that do not exist are skipped.
+func LoadPublicKeys(dirs ...string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("reading keys: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("reading key: %w", err)
+			}
+			for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+				if block.Type != "PUBLIC KEY" {
+					continue
+				}
+				key, err := x509.ParsePKIXPublicKey(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("parsing key %s: %w", path, err)
+				}
+				edKey, ok := key.(ed25519.PublicKey)
+				if !ok {
+					return nil, fmt.Errorf("key %s is not an ed25519 key", path)
+				}
+				keys = append(keys, edKey)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// ContentDigest returns the chain ID of the container's top image layer,
+// which identifies the content of all the layers below it. Returns "" if the
+// layers, set on mount, are unknown or have no chain IDs.
+func (c *Container) ContentDigest() string {
+	for _, layer := range c.Layers {
+		if layer.ChainID != "" {
+			return layer.ChainID
+		}
+	}
+	return ""
+}
+
+// SignaturePayload returns the bytes an extension's signature covers: a
+// version line, the content digest and the io.balena.image.* labels but the
+// signature itself, sorted, one per line:
+//
+//	mobynit-extension-v1
+//	content sha256:<chain ID>
+//	label io.balena.image.class=overlay
+func SignaturePayload(contentDigest string, labels map[string]string) []byte {
+	var lines []string
+	for key, val := range labels {
+		if strings.HasPrefix(key, HOSTOS_BLOCKS_LABEL_PREFIX) && key != HOSTOS_BLOCKS_SIGNATURE {
+			lines = append(lines, "label "+key+"="+val)
+		}
+	}
+	sort.Strings(lines)
+	lines = append([]string{signaturePayloadVersion, "content " + contentDigest}, lines...)
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// signature returns the container's base64-encoded signature, from its
+// signature label or else its detached signature file
+func (c *Container) signature() (string, error) {
+	if sig, ok := c.Labels[HOSTOS_BLOCKS_SIGNATURE]; ok {
+		return sig, nil
+	}
+	if c.HomePath == "" {
+		return "", errors.New("not signed")
+	}
+	content, err := os.ReadFile(filepath.Join(c.HomePath, SIGNATURE_FILE))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", errors.New("not signed")
+		}
+		return "", fmt.Errorf("reading signature: %w", err)
+	}
+	return string(content), nil
+}
+
+// VerifySignature checks the container's signature against keys. The
+// container must be mounted for its content digest to be known.
+func (c *Container) VerifySignature(keys []ed25519.PublicKey) error {
+	sig, err := c.signature()
+	if err != nil {
+		return err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sig))
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	digest := c.ContentDigest()
+	if digest == "" {
+		return errors.New("no content digest to verify")
+	}
+	payload := SignaturePayload(digest, c.Labels)
+	for _, key := range keys {
+		if ed25519.Verify(key, payload, decoded) {
+			return nil
+		}
+	}
+	return errors.New("signature does not match any trusted key")
+}
+
+// FilterBySignature drops containers whose signature does not verify against
+// keys. The signature only covers the layers' chain IDs, so the content of
+// every layer is also verified against layerdb and the container's own layer
+// must be empty, whether or not VerifyLayers is set. With no keys, signatures
+// are not enforced and all containers are kept.
+func FilterBySignature(containers []Container, keys []ed25519.PublicKey) []Container {
+	if len(keys) == 0 {
+		return containers
+	}
+	var filtered []Container
+	for _, c := range containers {
+		err := c.VerifySignature(keys)
+		if err == nil {
+			err = c.verifyLayers(c.layerRoot, c.Layers)
+		}
+		if err != nil {
+			log.Printf("Skipping container %s: %v", c.Name, err)
+			reportDropped(c, err.Error())
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
+
+// SelectSigned is FilterBySignature that also unmounts dropped containers,
+// like SelectMountable.
+func SelectSigned(containers []Container, keys []ed25519.PublicKey) []Container {
+	selected := FilterBySignature(containers, keys)
+	unmountDropped(containers, selected)
+	return selected
+}
@@ -0,0 +1,192 @@
+package hostapp
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePublicKey(t *testing.T, dir, name string, key ed25519.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadPublicKeys(t *testing.T) {
+	pub1, _, _ := ed25519.GenerateKey(nil)
+	pub2, _, _ := ed25519.GenerateKey(nil)
+	initramfs := filepath.Join(t.TempDir(), "keys")
+	hostapp := filepath.Join(t.TempDir(), "keys")
+	writePublicKey(t, initramfs, "release.pem", pub1)
+	writePublicKey(t, hostapp, "vendor.pem", pub2)
+
+	keys, err := LoadPublicKeys(initramfs, hostapp, filepath.Join(t.TempDir(), "missing"))
+	if err != nil {
+		t.Fatalf("LoadPublicKeys: %v", err)
+	}
+	if len(keys) != 2 || !keys[0].Equal(pub1) || !keys[1].Equal(pub2) {
+		t.Errorf("expected both keys, got %d", len(keys))
+	}
+
+	if err := os.WriteFile(filepath.Join(hostapp, "broken.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("junk")}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPublicKeys(hostapp); err == nil {
+		t.Error("expected error for an unparsable key")
+	}
+}
+
+func TestSignaturePayload(t *testing.T) {
+	got := string(SignaturePayload("sha256:abc", map[string]string{
+		"io.balena.image.override":  "10",
+		"io.balena.image.class":     "overlay",
+		"io.balena.image.signature": "ignored",
+		"org.example.unsigned":      "ignored",
+	}))
+	want := "mobynit-extension-v1\ncontent sha256:abc\nlabel io.balena.image.class=overlay\nlabel io.balena.image.override=10\n"
+	if got != want {
+		t.Errorf("expected payload %q, got %q", want, got)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	labels := map[string]string{"io.balena.image.class": "overlay"}
+	layers := []Layer{{ID: "own"}, {ID: "top", ChainID: "sha256:top"}, {ID: "base", ChainID: "sha256:base"}}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, SignaturePayload("sha256:top", labels)))
+
+	signed := func(sig string) Container {
+		c := Container{Config: Config{Name: "block", HostConfig: HostConfig{Labels: map[string]string{}}}, Layers: layers}
+		for k, v := range labels {
+			c.Labels[k] = v
+		}
+		c.Labels[HOSTOS_BLOCKS_SIGNATURE] = sig
+		return c
+	}
+
+	c := signed(sig)
+	if err := c.VerifySignature([]ed25519.PublicKey{otherPub, pub}); err != nil {
+		t.Errorf("expected label signature to verify, got %v", err)
+	}
+	if err := c.VerifySignature([]ed25519.PublicKey{otherPub}); err == nil {
+		t.Error("expected signature by an untrusted key to be rejected")
+	}
+
+	tampered := signed(sig)
+	tampered.Labels[HOSTOS_BLOCKS_OVERRIDE] = "1"
+	if err := tampered.VerifySignature([]ed25519.PublicKey{pub}); err == nil {
+		t.Error("expected signature to be rejected after adding a label")
+	}
+
+	swapped := signed(sig)
+	swapped.Layers = []Layer{{ID: "evil", ChainID: "sha256:evil"}}
+	if err := swapped.VerifySignature([]ed25519.PublicKey{pub}); err == nil {
+		t.Error("expected signature to be rejected for other content")
+	}
+
+	// Detached signature in the container's home directory
+	detached := Container{Config: Config{Name: "block", HostConfig: HostConfig{Labels: labels}}, Layers: layers, HomePath: t.TempDir()}
+	if err := detached.VerifySignature([]ed25519.PublicKey{pub}); err == nil {
+		t.Error("expected unsigned container to be rejected")
+	}
+	if err := os.WriteFile(filepath.Join(detached.HomePath, SIGNATURE_FILE), []byte(sig+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := detached.VerifySignature([]ed25519.PublicKey{pub}); err != nil {
+		t.Errorf("expected detached signature to verify, got %v", err)
+	}
+}
+
+func TestFilterBySignature(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	root := t.TempDir()
+	labels := map[string]string{"io.balena.image.class": "overlay"}
+	block := func(name string) Container {
+		base := writeVerifiableLayer(t, root, name+"-base", "", map[string]string{"etc/" + name: name})
+		top := writeVerifiableLayer(t, root, name+"-top", base.ChainID, verifyFixture)
+		own := Layer{ID: name + "-own", DiffPath: filepath.Join(root, "overlay2", name+"-own", "diff")}
+		if err := os.MkdirAll(own.DiffPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, SignaturePayload(top.ChainID, labels)))
+		return Container{
+			Config: Config{Name: name, Driver: "overlay2", HostConfig: HostConfig{Labels: map[string]string{
+				"io.balena.image.class": "overlay", HOSTOS_BLOCKS_SIGNATURE: sig,
+			}}},
+			Layers:    []Layer{own, top, base},
+			layerRoot: root,
+		}
+	}
+
+	good := block("good")
+	unsigned := block("unsigned")
+	delete(unsigned.Labels, HOSTOS_BLOCKS_SIGNATURE)
+	// Signed metadata does not vouch for content changed on disk
+	tampered := block("tampered")
+	if err := os.WriteFile(filepath.Join(tampered.Layers[1].DiffPath, "etc/issue"), []byte("evil"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	written := block("written")
+	if err := os.WriteFile(filepath.Join(written.Layers[0].DiffPath, "injected"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Content rewritten along with its diff ID and tar-split under the
+	// signed chain directory
+	swapped := block("swapped")
+	evilRoot := t.TempDir()
+	evil := writeVerifiableLayer(t, evilRoot, "swapped-top", swapped.Layers[2].ChainID, map[string]string{"etc/issue": "evilOS"})
+	for _, name := range []string{"diff", "tar-split.json.gz"} {
+		content, err := os.ReadFile(filepath.Join(chainDir(evilRoot, evil), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(chainDir(root, swapped.Layers[1]), name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(swapped.Layers[1].DiffPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(evil.DiffPath, swapped.Layers[1].DiffPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyLayer(root, swapped.Layers[1]); err != nil {
+		t.Fatalf("expected the swapped layer content to match its diff ID, got %v", err)
+	}
+	// The untouched layer of another image spliced into lower
+	spliced := block("spliced")
+	extra := writeVerifiableLayer(t, root, "extra", "", map[string]string{"usr/bin/evil": "evil"})
+	spliced.Layers = []Layer{spliced.Layers[0], spliced.Layers[1], extra, spliced.Layers[2]}
+	containers := []Container{good, unsigned, tampered, written, swapped, spliced}
+
+	if got := FilterBySignature(containers, nil); len(got) != len(containers) {
+		t.Errorf("expected no filtering without keys, got %d containers", len(got))
+	}
+	reasons := map[string]string{}
+	Dropped = func(c Container, reason string) { reasons[c.Name] = reason }
+	defer func() { Dropped = nil }()
+	got := FilterBySignature(containers, []ed25519.PublicKey{pub})
+	if len(got) != 1 || got[0].Name != "good" {
+		t.Errorf("expected only the signed container, got %+v", got)
+	}
+	for _, name := range []string{"swapped", "spliced"} {
+		if !strings.Contains(reasons[name], "chain ID") {
+			t.Errorf("expected %s to be dropped for its chain ID, got %q", name, reasons[name])
+		}
+	}
+}
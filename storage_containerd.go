@@ -0,0 +1,192 @@
+package hostapp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// CONTAINERD_SNAPSHOTTER_ROOT is where an engine using the containerd
+	// image store keeps its overlayfs snapshots, relative to its data root
+	CONTAINERD_SNAPSHOTTER_ROOT = "containerd/daemon/io.containerd.snapshotter.v1.overlayfs"
+	// CONTAINERD_NAMESPACE is the containerd namespace the engine uses
+	CONTAINERD_NAMESPACE = "moby"
+)
+
+// Bucket and key names of the snapshotter's metadata.db
+var (
+	bucketKeyVersion   = []byte("v1")
+	bucketKeySnapshots = []byte("snapshots")
+	bucketKeyID        = []byte("id")
+	bucketKeyParent    = []byte("parent")
+)
+
+// containerdLayers resolves the container's snapshot chain, top layer first,
+// from the containerd overlayfs snapshotter's metadata.db. The engine names
+// a container's snapshot after the container ID and image layer snapshots
+// after their chain IDs, both within its namespace: "moby/<n>/<name>". Init
+// snapshots are left out.
+func (container *Container) containerdLayers(layerRoot string) (string, []Layer, error) {
+	snapshotterRoot, err := filepath.Abs(filepath.Join(layerRoot, CONTAINERD_SNAPSHOTTER_ROOT))
+	if err != nil {
+		return "", nil, err
+	}
+	snapshotsDir := filepath.Join(snapshotterRoot, "snapshots")
+
+	dbPath := filepath.Join(snapshotterRoot, "metadata.db")
+	db, err := openSnapshotterDB(dbPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("opening %s: %w", dbPath, err)
+	}
+	defer db.Close()
+
+	var layers []Layer
+	err = db.View(func(tx *bolt.Tx) error {
+		version := tx.Bucket(bucketKeyVersion)
+		if version == nil {
+			return fmt.Errorf("%s: no %s bucket", dbPath, bucketKeyVersion)
+		}
+		snapshots := version.Bucket(bucketKeySnapshots)
+		if snapshots == nil {
+			return fmt.Errorf("%s: no %s bucket", dbPath, bucketKeySnapshots)
+		}
+
+		key, err := findSnapshotKey(snapshots, container.ID)
+		if err != nil {
+			return err
+		}
+		for key != "" {
+			snapshot := snapshots.Bucket([]byte(key))
+			if snapshot == nil {
+				return fmt.Errorf("snapshot %s not found", key)
+			}
+			id, n := binary.Uvarint(snapshot.Get(bucketKeyID))
+			if n <= 0 {
+				return fmt.Errorf("snapshot %s: invalid id", key)
+			}
+			sid := strconv.FormatUint(id, 10)
+
+			name := snapshotName(key)
+			if strings.HasSuffix(name, "-init") {
+				if Debug {
+					log.Printf("Skipping init snapshot: %s", key)
+				}
+			} else {
+				layer := Layer{
+					ID:       sid,
+					Link:     filepath.Join(sid, "fs"),
+					DiffPath: filepath.Join(snapshotsDir, sid, "fs"),
+				}
+				if strings.HasPrefix(name, "sha256:") {
+					layer.ChainID = name
+				}
+				layers = append(layers, layer)
+			}
+			key = string(snapshot.Get(bucketKeyParent))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(layers) == 0 {
+		return "", nil, fmt.Errorf("no snapshots for container %s", container.Name)
+	}
+
+	return filepath.Join(snapshotsDir, layers[0].ID), layers, nil
+}
+
+// snapshotterDB is an open metadata.db, possibly a copy removed on Close
+type snapshotterDB struct {
+	*bolt.DB
+	copyPath string
+}
+
+func (db snapshotterDB) Close() error {
+	err := db.DB.Close()
+	if db.copyPath != "" {
+		os.Remove(db.copyPath)
+	}
+	return err
+}
+
+// openSnapshotterDB opens the snapshotter's metadata.db read-only. A running
+// engine holds an exclusive lock on it, so when it cannot be opened in place
+// a copy is opened instead: the copy holds the last transaction committed.
+func openSnapshotterDB(dbPath string) (snapshotterDB, error) {
+	db, err := bolt.Open(dbPath, 0444, &bolt.Options{ReadOnly: true, Timeout: 100 * time.Millisecond})
+	if err == nil {
+		return snapshotterDB{DB: db}, nil
+	}
+	if !errors.Is(err, bolt.ErrTimeout) {
+		return snapshotterDB{}, err
+	}
+	if Debug {
+		log.Printf("%s is locked, reading a copy", dbPath)
+	}
+	copyPath, err := copyToTemp(dbPath)
+	if err != nil {
+		return snapshotterDB{}, fmt.Errorf("copying locked database: %w", err)
+	}
+	db, err = bolt.Open(copyPath, 0444, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		os.Remove(copyPath)
+		return snapshotterDB{}, err
+	}
+	return snapshotterDB{DB: db, copyPath: copyPath}, nil
+}
+
+// copyToTemp copies the file at path to a new temporary file, returning its path
+func copyToTemp(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp("", "mobynit-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// findSnapshotKey returns the key of the container's snapshot in the
+// engine's namespace
+func findSnapshotKey(snapshots *bolt.Bucket, containerID string) (string, error) {
+	prefix := []byte(CONTAINERD_NAMESPACE + "/")
+	c := snapshots.Cursor()
+	for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+		// Snapshots are nested buckets, which have no value
+		if v == nil && snapshotName(string(k)) == containerID {
+			return string(k), nil
+		}
+	}
+	return "", fmt.Errorf("no snapshot for container %s", containerID)
+}
+
+// snapshotName strips the "<namespace>/<n>/" prefix off a snapshot key
+func snapshotName(key string) string {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 {
+		return key
+	}
+	return parts[2]
+}
@@ -0,0 +1,189 @@
+package hostapp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sys/unix"
+)
+
+// containerdSnapshot describes one snapshot of a containerd fixture
+type containerdSnapshot struct {
+	key    string
+	id     uint64
+	parent string
+	files  map[string]string
+}
+
+// writeContainerdStore lays out a containerd overlayfs snapshotter under
+// root's CONTAINERD_SNAPSHOTTER_ROOT holding the given snapshots, and a
+// Docker container config using it. Returns the container, not yet mounted.
+func writeContainerdStore(t *testing.T, root, containerID string, snapshots []containerdSnapshot) Container {
+	t.Helper()
+	snapshotterRoot := filepath.Join(root, CONTAINERD_SNAPSHOTTER_ROOT)
+	for _, s := range snapshots {
+		fs := filepath.Join(snapshotterRoot, "snapshots", strconv.FormatUint(s.id, 10), "fs")
+		if err := os.MkdirAll(fs, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for path, content := range s.files {
+			full := filepath.Join(fs, path)
+			if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	db, err := bolt.Open(filepath.Join(snapshotterRoot, "metadata.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		version, err := tx.CreateBucketIfNotExists(bucketKeyVersion)
+		if err != nil {
+			return err
+		}
+		bkt, err := version.CreateBucketIfNotExists(bucketKeySnapshots)
+		if err != nil {
+			return err
+		}
+		for _, s := range snapshots {
+			snapshot, err := bkt.CreateBucket([]byte(s.key))
+			if err != nil {
+				return err
+			}
+			id := make([]byte, binary.MaxVarintLen64)
+			if err := snapshot.Put(bucketKeyID, id[:binary.PutUvarint(id, s.id)]); err != nil {
+				return err
+			}
+			if s.parent != "" {
+				if err := snapshot.Put(bucketKeyParent, []byte(s.parent)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home := filepath.Join(root, "containers", containerID)
+	if err := os.MkdirAll(home, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := json.Marshal(map[string]interface{}{"ID": containerID, "Name": containerID, "Driver": "overlayfs"})
+	if err := os.WriteFile(filepath.Join(home, "config.v2.json"), cfg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Container{Config: Config{ID: containerID, Name: containerID, Driver: "overlayfs"}, HomePath: home}
+}
+
+// containerdFixture is a container on top of an init snapshot and two image
+// layers, with an unrelated snapshot in another namespace.
+var containerdFixture = []containerdSnapshot{
+	{key: "moby/1/sha256:base", id: 1, files: map[string]string{"etc/issue": "base", "bin/sh": "sh"}},
+	{key: "moby/2/sha256:app", id: 2, parent: "moby/1/sha256:base", files: map[string]string{"etc/issue": "app"}},
+	{key: "moby/3/ctr-init", id: 3, parent: "moby/2/sha256:app", files: map[string]string{".dockerenv": ""}},
+	{key: "moby/4/ctr", id: 4, parent: "moby/3/ctr-init"},
+	{key: "other/5/ctr", id: 5},
+}
+
+func TestContainerdLayers(t *testing.T) {
+	root := t.TempDir()
+	c := writeContainerdStore(t, root, "ctr", containerdFixture)
+
+	layerDir, layers, err := c.layers(root)
+	if err != nil {
+		t.Fatalf("layers: %v", err)
+	}
+	snapshotsDir := filepath.Join(root, CONTAINERD_SNAPSHOTTER_ROOT, "snapshots")
+	if want := filepath.Join(snapshotsDir, "4"); layerDir != want {
+		t.Errorf("expected layer directory %s, got %s", want, layerDir)
+	}
+
+	var ids, links, chainIDs []string
+	for _, l := range layers {
+		ids = append(ids, l.ID)
+		links = append(links, l.LowerDir(snapshotsDir))
+		chainIDs = append(chainIDs, l.ChainID)
+	}
+	if want := []string{"4", "2", "1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("expected snapshots %v, got %v", want, ids)
+	}
+	if want := []string{"4/fs", "2/fs", "1/fs"}; !reflect.DeepEqual(links, want) {
+		t.Errorf("expected lowerdirs %v, got %v", want, links)
+	}
+	if want := []string{"", "sha256:app", "sha256:base"}; !reflect.DeepEqual(chainIDs, want) {
+		t.Errorf("expected chain IDs %v, got %v", want, chainIDs)
+	}
+
+	missing := Container{Config: Config{ID: "nope", Name: "nope", Driver: "overlayfs"}}
+	if _, _, err := missing.layers(root); err == nil {
+		t.Error("expected error for a container without a snapshot")
+	}
+}
+
+func TestContainerdLayersLocked(t *testing.T) {
+	root := t.TempDir()
+	c := writeContainerdStore(t, root, "ctr", containerdFixture)
+
+	// A running engine holds the database open for writing
+	db, err := bolt.Open(filepath.Join(root, CONTAINERD_SNAPSHOTTER_ROOT, "metadata.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, layers, err := c.layers(root)
+	if err != nil {
+		t.Fatalf("layers: %v", err)
+	}
+	if len(layers) != 3 {
+		t.Errorf("expected 3 snapshots, got %+v", layers)
+	}
+}
+
+func TestMountContainerd(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to perform overlay mount")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("unshare: %v", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("make mounts private: %v", err)
+	}
+
+	root := t.TempDir()
+	writeContainerdStore(t, root, "ctr", containerdFixture)
+
+	containers, err := Mount(root, "ctr")
+	if err != nil || len(containers) != 1 {
+		t.Fatalf("expected 1 mounted container, got %d (%v)", len(containers), err)
+	}
+	mountPath := containers[0].MountPath
+	defer unix.Unmount(mountPath, unix.MNT_DETACH)
+
+	if content, _ := os.ReadFile(filepath.Join(mountPath, "etc", "issue")); string(content) != "app" {
+		t.Errorf("expected upper image layer to win, got %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(mountPath, "bin", "sh")); err != nil {
+		t.Errorf("expected base layer file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mountPath, ".dockerenv")); !os.IsNotExist(err) {
+		t.Errorf("init snapshot should not be mounted: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package hostapp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// containers/storage (Podman, CRI-O) layout, relative to the store's root
+const (
+	CONTAINERS_STORAGE_CONTAINERS = "overlay-containers/containers.json"
+	CONTAINERS_STORAGE_IMAGES     = "overlay-images"
+	CONTAINERS_STORAGE_OVERLAY    = "overlay"
+)
+
+// storageContainer is an entry of containers/storage's containers.json
+type storageContainer struct {
+	ID    string   `json:"id"`
+	Names []string `json:"names"`
+	Image string   `json:"image"`
+	Layer string   `json:"layer"`
+}
+
+// storageImageConfig holds the part of an OCI image config mobynit reads
+type storageImageConfig struct {
+	Platform
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// listContainersStorage reads the containers of a containers/storage store
+// in rootdir. Containers carry the labels of their image's config, which is
+// where Podman and Buildah record them. The error is the bare os error when
+// the store has no containers.json.
+func listContainersStorage(rootdir string) ([]Container, error) {
+	content, err := os.ReadFile(filepath.Join(rootdir, CONTAINERS_STORAGE_CONTAINERS))
+	if err != nil {
+		return nil, err
+	}
+	var entries []storageContainer
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", CONTAINERS_STORAGE_CONTAINERS, err)
+	}
+
+	var containers []Container
+	for _, entry := range entries {
+		container := Container{
+			Config: Config{
+				ID:     entry.ID,
+				Name:   entry.ID,
+				Image:  entry.Image,
+				Driver: "overlay",
+			},
+			HomePath: filepath.Join(rootdir, filepath.Dir(CONTAINERS_STORAGE_CONTAINERS), entry.ID, "userdata"),
+			layerID:  entry.Layer,
+		}
+		if len(entry.Names) > 0 {
+			container.Name = entry.Names[0]
+		}
+		config, err := readStorageImageConfig(rootdir, entry.Image)
+		if err != nil {
+			log.Printf("Error reading labels of container %s: %v", container.Name, err)
+		}
+		container.Labels = config.Config.Labels
+		container.Platform = config.Platform
+		if Verbose || Debug {
+			log.Println("Initialized container:", container.Name)
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// readStorageImageConfig returns the config of the image imageID.
+// containers/storage keeps the config as image big data named after its
+// digest, base64-encoded as the digest is not a plain file name.
+func readStorageImageConfig(rootdir, imageID string) (storageImageConfig, error) {
+	var config storageImageConfig
+	if imageID == "" {
+		return config, nil
+	}
+	key := "sha256:" + imageID
+	configPath := filepath.Join(rootdir, CONTAINERS_STORAGE_IMAGES, imageID,
+		"="+base64.StdEncoding.EncodeToString([]byte(key)))
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, fmt.Errorf("reading image config: %w", err)
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return config, fmt.Errorf("decoding image config %s: %w", configPath, err)
+	}
+	return config, nil
+}
+
+// containersStorageLayers resolves the container's layer chain, top layer
+// first, from containers/storage's overlay directory, which uses the same
+// link and lower files as Docker's overlay2.
+func (container *Container) containersStorageLayers(layerRoot string) (string, []Layer, error) {
+	if container.layerID == "" || strings.ContainsRune(container.layerID, os.PathSeparator) {
+		return "", nil, fmt.Errorf("container %s has no valid layer", container.Name)
+	}
+	return overlayLayers(filepath.Join(layerRoot, CONTAINERS_STORAGE_OVERLAY), container.layerID)
+}
@@ -0,0 +1,159 @@
+package hostapp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// writeContainersStorage lays out a containers/storage store under root with
+// one container per entry of labels, named after the map key. Each container
+// sits on one image layer holding /<name> and has an empty layer of its own.
+func writeContainersStorage(t *testing.T, root string, labels map[string]map[string]string) {
+	t.Helper()
+	overlayDir := filepath.Join(root, CONTAINERS_STORAGE_OVERLAY)
+	if err := os.MkdirAll(filepath.Join(overlayDir, "l"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLayer := func(id, link, lower string, files map[string]string) {
+		diff := filepath.Join(overlayDir, id, "diff")
+		if err := os.MkdirAll(diff, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for path, content := range files {
+			if err := os.WriteFile(filepath.Join(diff, path), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(overlayDir, id, "link"), []byte(link), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if lower != "" {
+			if err := os.WriteFile(filepath.Join(overlayDir, id, "lower"), []byte(lower), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink(filepath.Join("..", id, "diff"), filepath.Join(overlayDir, "l", link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var entries []map[string]interface{}
+	for name, imageLabels := range labels {
+		imageID := strings.Repeat("0", 60) + "img" + name[:1]
+		imageLayer := name + "-image-layer"
+		writeLayer(imageLayer, strings.ToUpper(name)+"IMG", "", map[string]string{name: name})
+		writeLayer(name+"-layer", strings.ToUpper(name), "l/"+strings.ToUpper(name)+"IMG", nil)
+
+		config, _ := json.Marshal(map[string]interface{}{"config": map[string]interface{}{"Labels": imageLabels}})
+		imageDir := filepath.Join(root, CONTAINERS_STORAGE_IMAGES, imageID)
+		if err := os.MkdirAll(imageDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		configName := "=" + base64.StdEncoding.EncodeToString([]byte("sha256:"+imageID))
+		if err := os.WriteFile(filepath.Join(imageDir, configName), config, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		entries = append(entries, map[string]interface{}{
+			"id":    name + "-id",
+			"names": []string{name},
+			"image": imageID,
+			"layer": name + "-layer",
+		})
+	}
+	content, _ := json.Marshal(entries)
+	containersPath := filepath.Join(root, CONTAINERS_STORAGE_CONTAINERS)
+	if err := os.MkdirAll(filepath.Dir(containersPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(containersPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListContainersStorage(t *testing.T) {
+	root := t.TempDir()
+	writeContainersStorage(t, root, map[string]map[string]string{
+		"block": {"io.balena.image.class": "overlay"},
+		"tools": nil,
+	})
+
+	containers, err := List(root)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	byName := map[string]Container{}
+	for _, c := range containers {
+		byName[c.Name] = c
+	}
+	if len(byName) != 2 {
+		t.Fatalf("expected 2 containers, got %+v", containers)
+	}
+	block := byName["block"]
+	if block.ID != "block-id" || block.Driver != "overlay" {
+		t.Errorf("unexpected container %+v", block)
+	}
+	if block.Labels["io.balena.image.class"] != "overlay" {
+		t.Errorf("expected image labels on container, got %v", block.Labels)
+	}
+
+	layerDir, layers, err := block.layers(root)
+	if err != nil {
+		t.Fatalf("layers: %v", err)
+	}
+	if want := filepath.Join(root, CONTAINERS_STORAGE_OVERLAY, "block-layer"); layerDir != want {
+		t.Errorf("expected layer directory %s, got %s", want, layerDir)
+	}
+	var links []string
+	for _, l := range layers {
+		links = append(links, l.Link)
+	}
+	if want := []string{"l/BLOCK", "l/BLOCKIMG"}; !reflect.DeepEqual(links, want) {
+		t.Errorf("expected links %v, got %v", want, links)
+	}
+
+	// A store without Docker's containers directory nor containers.json
+	if _, err := List(t.TempDir()); err == nil {
+		t.Error("expected error for an empty storage root")
+	}
+}
+
+func TestMountContainersStorageByLabel(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to perform overlay mount")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("unshare: %v", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("make mounts private: %v", err)
+	}
+
+	root := t.TempDir()
+	writeContainersStorage(t, root, map[string]map[string]string{
+		"block": {"io.balena.image.class": "overlay"},
+		"tools": nil,
+	})
+
+	containers, err := Mount(root, "io.balena.image.class")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	if len(containers) != 1 || containers[0].Name != "block" {
+		t.Fatalf("expected only the labelled container, got %+v", containers)
+	}
+	defer unix.Unmount(containers[0].MountPath, unix.MNT_DETACH)
+	if _, err := os.Stat(filepath.Join(containers[0].MountPath, "block")); err != nil {
+		t.Errorf("expected image layer content in mount: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package hostapp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// dockerImageConfig holds the part of an image config in Docker's imagedb
+// mobynit reads
+type dockerImageConfig struct {
+	Platform
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// ChainIDs returns the layer chain IDs for an image's rootfs diff IDs, bottom
+// layer first: the first chain ID is the first diff ID, each following one is
+// sha256("<parent chain ID> <diff ID>").
+func ChainIDs(diffIDs []string) []string {
+	chainIDs := make([]string, 0, len(diffIDs))
+	for i, diffID := range diffIDs {
+		if i == 0 {
+			chainIDs = append(chainIDs, diffID)
+			continue
+		}
+		sum := sha256.Sum256([]byte(chainIDs[i-1] + " " + diffID))
+		chainIDs = append(chainIDs, "sha256:"+hex.EncodeToString(sum[:]))
+	}
+	return chainIDs
+}
+
+// imageNames maps image IDs to their first repository reference, in
+// lexical order, from the overlay2 repositories.json
+func imageNames(rootdir string) map[string]string {
+	content, err := os.ReadFile(filepath.Join(rootdir, "image", "overlay2", "repositories.json"))
+	if err != nil {
+		return nil
+	}
+	var repositories struct {
+		Repositories map[string]map[string]string `json:"Repositories"`
+	}
+	if err := json.Unmarshal(content, &repositories); err != nil {
+		return nil
+	}
+	var refs []string
+	ids := make(map[string]string)
+	for _, repo := range repositories.Repositories {
+		for ref, id := range repo {
+			refs = append(refs, ref)
+			ids[ref] = id
+		}
+	}
+	sort.Strings(refs)
+	names := make(map[string]string)
+	for _, ref := range refs {
+		if _, ok := names[ids[ref]]; !ok {
+			names[ids[ref]] = ref
+		}
+	}
+	return names
+}
+
+// listImages reads the images in rootdir's overlay2 imagedb as containers
+// that can be mounted directly: each is named after its repository reference
+// and resolves its layer chain through layerdb/sha256/<chain-id>/cache-id.
+// Images whose layers are not all present are skipped.
+func listImages(rootdir string) ([]Container, error) {
+	contentDir := filepath.Join(rootdir, "image", "overlay2", "imagedb", "content", "sha256")
+	entries, err := os.ReadDir(contentDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading imagedb: %w", err)
+	}
+	names := imageNames(rootdir)
+
+	var images []Container
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		image, err := readImage(rootdir, entry.Name())
+		if err != nil {
+			log.Println("Error reading image:", err)
+			continue
+		}
+		if name, ok := names[image.Image]; ok {
+			image.Name = name
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// readImage reads the image id from the imagedb and resolves its top layer
+func readImage(rootdir, id string) (Container, error) {
+	configPath := filepath.Join(rootdir, "image", "overlay2", "imagedb", "content", "sha256", id)
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return Container{}, fmt.Errorf("reading %s: %w", configPath, err)
+	}
+	var config dockerImageConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return Container{}, fmt.Errorf("decoding %s: %w", configPath, err)
+	}
+	if len(config.RootFS.DiffIDs) == 0 {
+		return Container{}, fmt.Errorf("image %s has no layers", id)
+	}
+
+	chainIDs := ChainIDs(config.RootFS.DiffIDs)
+	topChainID := strings.TrimPrefix(chainIDs[len(chainIDs)-1], "sha256:")
+	cacheIDPath := filepath.Join(rootdir, "image", "overlay2", "layerdb", "sha256", topChainID, "cache-id")
+	cacheID, err := os.ReadFile(cacheIDPath)
+	if err != nil {
+		return Container{}, fmt.Errorf("image %s: reading cache-id: %w", id, err)
+	}
+
+	image := Container{
+		Config: Config{
+			HostConfig: HostConfig{Labels: config.Config.Labels},
+			ID:         id,
+			Name:       "sha256:" + id,
+			Image:      "sha256:" + id,
+			Driver:     "overlay2",
+		},
+		Platform: config.Platform,
+		layerID:  strings.TrimSpace(string(cacheID)),
+	}
+	if Verbose || Debug {
+		log.Println("Initialized image:", image.Name)
+	}
+	return image, nil
+}
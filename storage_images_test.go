@@ -0,0 +1,182 @@
+package hostapp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestChainIDs(t *testing.T) {
+	sum := sha256.Sum256([]byte("sha256:aaa sha256:bbb"))
+	second := "sha256:" + hex.EncodeToString(sum[:])
+	sum = sha256.Sum256([]byte(second + " sha256:ccc"))
+	third := "sha256:" + hex.EncodeToString(sum[:])
+
+	got := ChainIDs([]string{"sha256:aaa", "sha256:bbb", "sha256:ccc"})
+	if want := []string{"sha256:aaa", second, third}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if got := ChainIDs(nil); len(got) != 0 {
+		t.Errorf("expected no chain IDs, got %v", got)
+	}
+}
+
+// writeImage turns the image layers of a writeOverlay2Container fixture into
+// a pulled image: an imagedb config with the given labels, layerdb cache-ids
+// for its chain, and a repositories.json reference. The fixture's top layer
+// becomes the image's top layer. Returns the image ID.
+func writeImage(t *testing.T, root, name string, labels map[string]string, layerCount int) string {
+	t.Helper()
+	var diffIDs []string
+	for i := layerCount - 1; i >= 0; i-- {
+		diffIDs = append(diffIDs, "sha256:"+strings.Repeat(string(rune('a'+i)), 64))
+	}
+	chainIDs := ChainIDs(diffIDs)
+	layerChainIDs := map[string]string{}
+	for i, chainID := range chainIDs {
+		layerChainIDs[name+"-layer"+string(rune('0'+layerCount-1-i))] = strings.TrimPrefix(chainID, "sha256:")
+	}
+	writeChainIDs(t, root, layerChainIDs)
+
+	config := map[string]interface{}{
+		"config": map[string]interface{}{"Labels": labels},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	}
+	content, _ := json.Marshal(config)
+	sum := sha256.Sum256(content)
+	id := hex.EncodeToString(sum[:])
+	contentDir := filepath.Join(root, "image", "overlay2", "imagedb", "content", "sha256")
+	if err := os.MkdirAll(contentDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(contentDir, id), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	repositories, _ := json.Marshal(map[string]interface{}{
+		"Repositories": map[string]interface{}{name: map[string]string{name + ":latest": "sha256:" + id}},
+	})
+	if err := os.WriteFile(filepath.Join(root, "image", "overlay2", "repositories.json"), repositories, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestListImages(t *testing.T) {
+	root := t.TempDir()
+	writeOverlay2Container(t, root, "block", nil, []map[string]string{{"top": ""}, {"bottom": ""}})
+	id := writeImage(t, root, "block", map[string]string{"io.balena.image.class": "overlay"}, 2)
+
+	images, err := listImages(root)
+	if err != nil {
+		t.Fatalf("listImages: %v", err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("expected 1 image, got %+v", images)
+	}
+	image := images[0]
+	if image.ID != id || image.Name != "block:latest" || image.Labels["io.balena.image.class"] != "overlay" {
+		t.Errorf("unexpected image %+v", image)
+	}
+
+	_, layers, err := image.layers(root)
+	if err != nil {
+		t.Fatalf("layers: %v", err)
+	}
+	var ids []string
+	for _, l := range layers {
+		ids = append(ids, l.ID)
+		if l.ChainID == "" {
+			t.Errorf("image layer %s should have a chain ID", l.ID)
+		}
+	}
+	if want := []string{"block-layer0", "block-layer1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("expected layers %v, got %v", want, ids)
+	}
+
+	if images, err := listImages(t.TempDir()); err != nil || len(images) != 0 {
+		t.Errorf("expected no images without an imagedb, got %v (%v)", images, err)
+	}
+}
+
+func TestFindSkipsDanglingImages(t *testing.T) {
+	root := t.TempDir()
+	block := writeOverlay2Container(t, root, "block", nil, []map[string]string{{"block": "block"}})
+	writeImage(t, root, "block", map[string]string{"io.balena.image.class": "overlay"}, 1)
+	if err := os.RemoveAll(block.HomePath); err != nil {
+		t.Fatal(err)
+	}
+	// The tag moved on, leaving the labelled image without a reference
+	if err := os.WriteFile(filepath.Join(root, "image", "overlay2", "repositories.json"), []byte(`{"Repositories":{}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	containers, err := Find(root, "io.balena.image.class")
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	if len(containers) != 0 {
+		t.Errorf("expected the dangling image to be skipped, got %+v", containers)
+	}
+}
+
+func TestMountImagesByLabel(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to perform overlay mount")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("unshare: %v", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("make mounts private: %v", err)
+	}
+
+	root := t.TempDir()
+	block := writeOverlay2Container(t, root, "block", nil, []map[string]string{{"block": "block"}})
+	id := writeImage(t, root, "block", map[string]string{"io.balena.image.class": "overlay"}, 1)
+	// Only the image is left: no docker create step
+	if err := os.RemoveAll(block.HomePath); err != nil {
+		t.Fatal(err)
+	}
+
+	containers, err := Mount(root, "io.balena.image.class")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	if len(containers) != 1 || containers[0].ID != id {
+		t.Fatalf("expected the labelled image to be mounted, got %+v", containers)
+	}
+	defer unix.Unmount(containers[0].MountPath, unix.MNT_DETACH)
+	if _, err := os.Stat(filepath.Join(containers[0].MountPath, "block")); err != nil {
+		t.Errorf("expected image content in mount: %v", err)
+	}
+
+	// A labelled container created from the image is used instead of it
+	ctr := writeOverlay2Container(t, root, "ctr", map[string]string{"io.balena.image.class": "overlay"}, []map[string]string{{}})
+	cfg, _ := json.Marshal(map[string]interface{}{
+		"ID": ctr.ID, "Name": ctr.Name, "Driver": "overlay2", "Image": "sha256:" + id,
+		"Config": map[string]interface{}{"Labels": ctr.Labels},
+	})
+	if err := os.WriteFile(filepath.Join(ctr.HomePath, "config.v2.json"), cfg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	containers, err = Mount(root, "io.balena.image.class")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	for _, c := range containers {
+		defer unix.Unmount(c.MountPath, unix.MNT_DETACH)
+	}
+	if len(containers) != 1 || containers[0].ID != ctr.ID {
+		t.Errorf("expected only the container, got %+v", containers)
+	}
+}
@@ -0,0 +1,157 @@
+package hostapp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNotMounted is returned by UnmountID for a container that is not mounted
+var ErrNotMounted = errors.New("not mounted")
+
+// Holder is a process using files in a mount
+type Holder struct {
+	PID     int
+	Command string
+}
+
+// BusyError is returned by UnmountID when the container's mount was busy and
+// was detached lazily instead: it is gone from the mount namespace, but the
+// filesystem stays alive until Holders let go of it.
+type BusyError struct {
+	Path    string
+	Holders []Holder
+}
+
+func (e *BusyError) Error() string {
+	var holders []string
+	for _, h := range e.Holders {
+		holders = append(holders, fmt.Sprintf("%s (%d)", h.Command, h.PID))
+	}
+	if len(holders) == 0 {
+		return fmt.Sprintf("%s was busy and was detached lazily", e.Path)
+	}
+	return fmt.Sprintf("%s was busy and was detached lazily, held by %s", e.Path, strings.Join(holders, ", "))
+}
+
+// UnmountID unmounts the container with exactly the given ID from its
+// merged directory, where MountID mounts it. A busy mount is detached lazily
+// and reported with a BusyError.
+func UnmountID(rootdir string, id string) (Container, error) {
+	container, err := loadID(rootdir, id)
+	if err != nil {
+		return container, err
+	}
+	layerDir, _, err := container.layers(rootdir)
+	if err != nil {
+		return container, err
+	}
+	mountPoint := filepath.Join(layerDir, "merged")
+	container.MountPath = mountPoint
+
+	err = unmountError(mountPoint, container.unmount())
+	var busy *BusyError
+	if err == nil || errors.Is(err, ErrNotMounted) || errors.As(err, &busy) {
+		container.MountPath = ""
+	}
+	return container, err
+}
+
+// Unmount unmounts path the way UnmountID unmounts a container
+func Unmount(path string) error {
+	err := unix.Unmount(path, 0)
+	if err != nil {
+		err = fmt.Errorf("unmounting %s: %w", path, err)
+	}
+	return unmountError(path, err)
+}
+
+// unmountError maps the error unmounting path to ErrNotMounted, or detaches
+// a busy mount lazily and returns a BusyError naming its holders
+func unmountError(path string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOENT):
+		return fmt.Errorf("%s: %w", path, ErrNotMounted)
+	case !errors.Is(err, unix.EBUSY):
+		return err
+	}
+
+	holders := mountHolders("/proc", path)
+	if Debug {
+		log.Printf("%s is busy, detaching it lazily", path)
+	}
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching %s: %w", path, err)
+	}
+	return &BusyError{Path: path, Holders: holders}
+}
+
+// mountHolders returns the processes in procDir whose working directory,
+// root, executable, open files or mapped files are under path
+func mountHolders(procDir, path string) []Holder {
+	under := func(p string) bool {
+		return p == path || strings.HasPrefix(p, path+"/")
+	}
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil
+	}
+	var holders []Holder
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		pidDir := filepath.Join(procDir, entry.Name())
+		links := []string{"cwd", "root", "exe"}
+		if fds, err := os.ReadDir(filepath.Join(pidDir, "fd")); err == nil {
+			for _, fd := range fds {
+				links = append(links, filepath.Join("fd", fd.Name()))
+			}
+		}
+		holds := false
+		for _, link := range links {
+			if target, err := os.Readlink(filepath.Join(pidDir, link)); err == nil && under(target) {
+				holds = true
+				break
+			}
+		}
+		if !holds {
+			holds = mapsUnder(filepath.Join(pidDir, "maps"), under)
+		}
+		if holds {
+			comm, _ := os.ReadFile(filepath.Join(pidDir, "comm"))
+			holders = append(holders, Holder{PID: pid, Command: strings.TrimSpace(string(comm))})
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].PID < holders[j].PID })
+	return holders
+}
+
+// mapsUnder tells whether a file mapped in a /proc/<pid>/maps file is under
+func mapsUnder(mapsPath string, under func(string) bool) bool {
+	f, err := os.Open(mapsPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 6 && under(fields[5]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package hostapp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMountHolders(t *testing.T) {
+	proc := t.TempDir()
+	process := func(pid, comm string, links map[string]string, maps string) {
+		dir := filepath.Join(proc, pid)
+		if err := os.MkdirAll(filepath.Join(dir, "fd"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "maps"), []byte(maps), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for link, target := range links {
+			if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	process("10", "shell", map[string]string{"cwd": "/mnt/merged/etc", "root": "/"}, "")
+	process("20", "reader", map[string]string{"cwd": "/", "fd/3": "/mnt/merged/usr/lib/os-release"}, "")
+	process("30", "daemon", map[string]string{"cwd": "/"},
+		"7f0000000000-7f0000001000 r-xp 00000000 00:2a 1234 /mnt/merged/usr/lib/libc.so\n")
+	process("40", "neighbour", map[string]string{"cwd": "/mnt/merged2", "fd/0": "/dev/null"},
+		"7f0000000000-7f0000001000 rw-p 00000000 00:00 0 \n")
+	if err := os.MkdirAll(filepath.Join(proc, "self"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	holders := mountHolders(proc, "/mnt/merged")
+	want := []Holder{{10, "shell"}, {20, "reader"}, {30, "daemon"}}
+	if len(holders) != len(want) {
+		t.Fatalf("expected holders %v, got %v", want, holders)
+	}
+	for i := range want {
+		if holders[i] != want[i] {
+			t.Errorf("expected holders %v, got %v", want, holders)
+		}
+	}
+}
+
+func TestUnmountID(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to perform overlay mount")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		t.Fatalf("unshare: %v", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		t.Fatalf("make mounts private: %v", err)
+	}
+
+	root := t.TempDir()
+	c := writeOverlay2Container(t, root, "hostapp", nil, []map[string]string{{"etc/issue": "top"}, {"etc/hosts": "base"}})
+	mounted, err := MountID(root, c.ID)
+	if err != nil {
+		t.Fatalf("MountID: %v", err)
+	}
+	defer unix.Unmount(mounted.MountPath, unix.MNT_DETACH)
+
+	if _, err := UnmountID(root, c.ID); err != nil {
+		t.Fatalf("UnmountID: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mounted.MountPath, "etc", "issue")); err == nil {
+		t.Errorf("expected %s to be unmounted", mounted.MountPath)
+	}
+	if _, err := UnmountID(root, c.ID); !errors.Is(err, ErrNotMounted) {
+		t.Errorf("expected ErrNotMounted, got %v", err)
+	}
+
+	// A busy mount is detached lazily
+	if mounted, err = MountID(root, c.ID); err != nil {
+		t.Fatalf("MountID: %v", err)
+	}
+	f, err := os.Open(filepath.Join(mounted.MountPath, "etc", "issue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = UnmountID(root, c.ID)
+	var busy *BusyError
+	if !errors.As(err, &busy) {
+		t.Fatalf("expected a BusyError, got %v", err)
+	}
+	found := false
+	for _, holder := range busy.Holders {
+		found = found || holder.PID == os.Getpid()
+	}
+	if !found {
+		t.Errorf("expected this process among the holders, got %v", busy.Holders)
+	}
+}
@@ -0,0 +1,317 @@
+package hostapp
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// tar-split entry types, see github.com/vbatts/tar-split/tar/storage
+const (
+	tarSplitFileType    = 1
+	tarSplitSegmentType = 2
+)
+
+// Whiteout markers in layer tar streams. overlay2 stores whiteouts as 0/0
+// character devices and opaque directories as an xattr.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// tarSplitEntry is one line of a layer's tar-split.json.gz. Segments hold the
+// raw tar headers and padding; file entries stand for the file content, read
+// back from the layer's diff directory.
+type tarSplitEntry struct {
+	Type    int    `json:"type"`
+	Name    string `json:"name,omitempty"`
+	NameRaw []byte `json:"name_raw,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Payload []byte `json:"payload"`
+}
+
+func (entry tarSplitEntry) name() string {
+	if len(entry.NameRaw) > 0 {
+		return string(entry.NameRaw)
+	}
+	return entry.Name
+}
+
+// diffPath returns where name, a path in a layer tar stream, lives in the
+// layer's diff directory. Names cannot escape the directory.
+func diffPath(diff, name string) string {
+	return filepath.Join(diff, filepath.Join("/", name))
+}
+
+// verifyLayers checks the container's layers against the digests Docker
+// recorded in layerdb, after checking those digests against the chain IDs
+// (see verifyChain). Layers without a chain ID - the container's own layer -
+// have no digest and must be empty.
+func (container *Container) verifyLayers(layerRoot string, layers []Layer) error {
+	if container.Driver != "overlay2" {
+		return fmt.Errorf("layer verification is not supported for %s storage", container.Driver)
+	}
+	if err := verifyChain(layerRoot, layers); err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if layer.ChainID == "" {
+			entries, err := os.ReadDir(layer.DiffPath)
+			if err != nil {
+				return fmt.Errorf("reading layer %s: %w", layer.ID, err)
+			}
+			if len(entries) > 0 {
+				return fmt.Errorf("layer %s has no recorded digest and is not empty", layer.ID)
+			}
+			continue
+		}
+		if err := VerifyLayer(layerRoot, layer); err != nil {
+			return err
+		}
+	}
+	if Debug {
+		log.Printf("Verified %d layers of %s", len(layers), container.Name)
+	}
+	return nil
+}
+
+// verifyChain recomputes the chain IDs of layers, top first, bottom up from
+// the diff IDs recorded in layerdb as ChainIDs does, and checks each against
+// the chain ID the layer was resolved to, i.e. its layerdb directory. The
+// top chain ID then vouches for every diff ID below it: a diff ID rewritten
+// under its chain directory, or a layer spliced into the chain, is rejected.
+// Only the container's own layer, on top, may have no chain ID.
+func verifyChain(layerRoot string, layers []Layer) error {
+	parent := ""
+	for i := len(layers) - 1; i >= 0; i-- {
+		layer := layers[i]
+		if layer.ChainID == "" {
+			if i != 0 {
+				return fmt.Errorf("layer %s has no recorded digest and is not the container's own layer", layer.ID)
+			}
+			continue
+		}
+		diffID, err := readDiffID(layerRoot, layer)
+		if err != nil {
+			return err
+		}
+		chainID := diffID
+		if parent != "" {
+			sum := sha256.Sum256([]byte(parent + " " + diffID))
+			chainID = "sha256:" + hex.EncodeToString(sum[:])
+		}
+		if chainID != layer.ChainID {
+			return fmt.Errorf("layer %s: chain ID %s does not match recorded %s", layer.ID, chainID, layer.ChainID)
+		}
+		parent = chainID
+	}
+	return nil
+}
+
+// readDiffID returns the diff ID layerdb records for the layer
+func readDiffID(layerRoot string, layer Layer) (string, error) {
+	diffID, err := os.ReadFile(filepath.Join(chainDir(layerRoot, layer), "diff"))
+	if err != nil {
+		return "", fmt.Errorf("layer %s: reading diff ID: %w", layer.ID, err)
+	}
+	return strings.TrimSpace(string(diffID)), nil
+}
+
+// chainDir returns the layer's layerdb directory
+func chainDir(layerRoot string, layer Layer) string {
+	return filepath.Join(layerRoot, "image", "overlay2", "layerdb", "sha256", strings.TrimPrefix(layer.ChainID, "sha256:"))
+}
+
+// VerifyLayer rebuilds the layer's tar stream from its diff directory and
+// layerdb/sha256/<chain>/tar-split.json.gz and compares its digest with the
+// layer's recorded diff ID. The headers of the stream are checked against
+// the files on disk, and files the stream does not know about are rejected,
+// as neither would change the digest.
+func VerifyLayer(layerRoot string, layer Layer) error {
+	diffID, err := readDiffID(layerRoot, layer)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(chainDir(layerRoot, layer), "tar-split.json.gz"))
+	if err != nil {
+		return fmt.Errorf("layer %s: opening tar-split: %w", layer.ID, err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("layer %s: reading tar-split: %w", layer.ID, err)
+	}
+	defer gz.Close()
+
+	digest := sha256.New()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(assembleTar(io.MultiWriter(digest, pw), gz, layer.DiffPath))
+	}()
+	seen, err := checkTarHeaders(pr, layer.DiffPath)
+	if err == nil {
+		// Drain the end of archive padding into the digest
+		_, err = io.Copy(io.Discard, pr)
+	}
+	pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("layer %s: %w", layer.ID, err)
+	}
+
+	sum := "sha256:" + hex.EncodeToString(digest.Sum(nil))
+	if sum != diffID {
+		return fmt.Errorf("layer %s: digest %s does not match recorded %s", layer.ID, sum, diffID)
+	}
+	return checkUnknownFiles(layer.DiffPath, seen)
+}
+
+// assembleTar writes the tar stream described by the tar-split entries read
+// from r, taking file content from diff.
+func assembleTar(w io.Writer, r io.Reader, diff string) error {
+	dec := json.NewDecoder(r)
+	for {
+		var entry tarSplitEntry
+		if err := dec.Decode(&entry); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("decoding tar-split: %w", err)
+		}
+		switch entry.Type {
+		case tarSplitSegmentType:
+			if _, err := w.Write(entry.Payload); err != nil {
+				return err
+			}
+		case tarSplitFileType:
+			if entry.Size == 0 {
+				continue
+			}
+			if err := copyFile(w, diffPath(diff, entry.name()), entry.Size); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown tar-split entry type %d", entry.Type)
+		}
+	}
+}
+
+// copyFile writes the content of path, which must be size bytes long
+func copyFile(w io.Writer, path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(w, f, size); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%s is shorter than recorded", path)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkTarHeaders reads the tar stream and checks that every entry exists in
+// diff with the recorded type, size, mode, ownership and link target.
+// Returns the diff paths the stream accounts for.
+func checkTarHeaders(r io.Reader, diff string) (map[string]bool, error) {
+	seen := map[string]bool{diff: true}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return seen, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tar stream: %w", err)
+		}
+		dir, base := filepath.Split(hdr.Name)
+		if base == whiteoutOpaque {
+			continue
+		}
+		path := diffPath(diff, hdr.Name)
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			path = diffPath(diff, filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		}
+		seen[path] = true
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			if fi.Mode()&fs.ModeCharDevice == 0 {
+				return nil, fmt.Errorf("%s is not a whiteout", path)
+			}
+			continue
+		}
+		if err := checkHeader(hdr, path, fi); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// checkHeader compares a tar header with the file at path
+func checkHeader(hdr *tar.Header, path string, fi fs.FileInfo) error {
+	want := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		// Hard links share the inode of their target, checked on its own
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		return nil
+	case tar.TypeReg:
+		if !fi.Mode().IsRegular() || fi.Size() != hdr.Size {
+			return fmt.Errorf("%s does not match its recorded type or size", path)
+		}
+	case tar.TypeSymlink:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if target != hdr.Linkname {
+			return fmt.Errorf("%s links to %s instead of %s", path, target, hdr.Linkname)
+		}
+		return nil
+	default:
+		if fi.Mode().Type() != want.Type() {
+			return fmt.Errorf("%s does not match its recorded type", path)
+		}
+	}
+	if fi.Mode() != want {
+		return fmt.Errorf("%s has mode %v instead of %v", path, fi.Mode(), want)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && (int(st.Uid) != hdr.Uid || int(st.Gid) != hdr.Gid) {
+		return fmt.Errorf("%s is owned by %d:%d instead of %d:%d", path, st.Uid, st.Gid, hdr.Uid, hdr.Gid)
+	}
+	return nil
+}
+
+// checkUnknownFiles rejects files in diff the layer's tar stream did not
+// account for
+func checkUnknownFiles(diff string, seen map[string]bool) error {
+	err := filepath.WalkDir(diff, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !seen[path] {
+			return fmt.Errorf("%s is not part of the layer", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("verifying %s: %w", diff, err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package hostapp
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeVerifiableLayer creates a layer holding files, where a value starting
+// with "->" is a symlink, under root's overlay2 directory, and records its
+// tar-split and diff ID in layerdb under its chain ID on top of parent, a
+// chain ID or "" for a base layer, as dockerd does on pull.
+func writeVerifiableLayer(t *testing.T, root, id, parent string, files map[string]string) Layer {
+	t.Helper()
+	diff := filepath.Join(root, "overlay2", id, "diff")
+	for name, content := range files {
+		path := filepath.Join(diff, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if target, ok := strings.CutPrefix(content, "->"); ok {
+			if err := os.Symlink(target, path); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Build the tar stream, recording everything but file content as
+	// tar-split segments
+	var stream bytes.Buffer
+	var entries []tarSplitEntry
+	mark := 0
+	segment := func() {
+		entries = append(entries, tarSplitEntry{Type: tarSplitSegmentType, Payload: append([]byte(nil), stream.Bytes()[mark:]...)})
+		mark = stream.Len()
+	}
+	tw := tar.NewWriter(&stream)
+	err := filepath.WalkDir(diff, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == diff {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link, _ := os.Readlink(path)
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name, _ = filepath.Rel(diff, path)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		segment()
+		entries = append(entries, tarSplitEntry{Type: tarSplitFileType, Name: hdr.Name, Size: hdr.Size})
+		if fi.Mode().IsRegular() {
+			content, _ := os.ReadFile(path)
+			tw.Write(content)
+			mark = stream.Len()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	segment()
+
+	sum := sha256.Sum256(stream.Bytes())
+	diffID := "sha256:" + hex.EncodeToString(sum[:])
+	chainIDs := ChainIDs([]string{diffID})
+	if parent != "" {
+		chainIDs = ChainIDs([]string{parent, diffID})
+	}
+	chainID := chainIDs[len(chainIDs)-1]
+	chainDir := filepath.Join(root, "image", "overlay2", "layerdb", "sha256", strings.TrimPrefix(chainID, "sha256:"))
+	if err := os.MkdirAll(chainDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(chainDir, "diff"), []byte(diffID), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var tarSplit bytes.Buffer
+	gz := gzip.NewWriter(&tarSplit)
+	enc := json.NewEncoder(gz)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gz.Close()
+	if err := os.WriteFile(filepath.Join(chainDir, "tar-split.json.gz"), tarSplit.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Layer{ID: id, DiffPath: diff, ChainID: chainID}
+}
+
+var verifyFixture = map[string]string{
+	"etc/issue":     "balenaOS",
+	"bin/sh":        "shell",
+	"sbin/init":     "->../bin/sh",
+	"usr/lib/empty": "",
+}
+
+func TestVerifyLayer(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(diff string) error
+		valid  bool
+	}{
+		{"intact", func(string) error { return nil }, true},
+		{"modified content", func(diff string) error {
+			return os.WriteFile(filepath.Join(diff, "etc", "issue"), []byte("evilOS!!"), 0644)
+		}, false},
+		{"truncated file", func(diff string) error {
+			return os.WriteFile(filepath.Join(diff, "bin", "sh"), []byte("sh"), 0644)
+		}, false},
+		{"added file", func(diff string) error {
+			return os.WriteFile(filepath.Join(diff, "etc", "extra"), []byte(""), 0644)
+		}, false},
+		{"retargeted symlink", func(diff string) error {
+			if err := os.Remove(filepath.Join(diff, "sbin", "init")); err != nil {
+				return err
+			}
+			return os.Symlink("/tmp/evil", filepath.Join(diff, "sbin", "init"))
+		}, false},
+		{"changed mode", func(diff string) error {
+			return os.Chmod(filepath.Join(diff, "bin", "sh"), 04755)
+		}, false},
+		{"removed file", func(diff string) error {
+			return os.Remove(filepath.Join(diff, "usr", "lib", "empty"))
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			layer := writeVerifiableLayer(t, root, "layer", "", verifyFixture)
+			if err := tt.tamper(layer.DiffPath); err != nil {
+				t.Fatal(err)
+			}
+			err := VerifyLayer(root, layer)
+			if tt.valid && err != nil {
+				t.Errorf("expected layer to verify, got %v", err)
+			} else if !tt.valid && err == nil {
+				t.Error("expected tampered layer to be rejected")
+			}
+		})
+	}
+}
+
+func TestVerifyLayers(t *testing.T) {
+	root := t.TempDir()
+	layer := writeVerifiableLayer(t, root, "layer", "", verifyFixture)
+	own := Layer{ID: "own", DiffPath: filepath.Join(root, "overlay2", "own", "diff")}
+	if err := os.MkdirAll(own.DiffPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	container := Container{Config: Config{Name: "hostapp", Driver: "overlay2"}}
+	if err := container.verifyLayers(root, []Layer{own, layer}); err != nil {
+		t.Errorf("expected layers to verify, got %v", err)
+	}
+
+	// The container's own layer has no digest to check it against
+	if err := os.WriteFile(filepath.Join(own.DiffPath, "injected"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := container.verifyLayers(root, []Layer{own, layer}); err == nil {
+		t.Error("expected a non-empty container layer to be rejected")
+	}
+
+	containerd := Container{Config: Config{Name: "ctr", Driver: "overlayfs"}}
+	if err := containerd.verifyLayers(root, []Layer{layer}); err == nil {
+		t.Error("expected verification to be refused for containerd snapshots")
+	}
+}
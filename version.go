@@ -0,0 +1,178 @@
+package hostapp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VersionConstraint is a parsed version constraint label, such as
+// io.balena.image.kernel-version: a comma separated list of alternatives,
+// any of which the version may satisfy. An alternative is one of
+//
+//   - a version, "6.1.0", matching the numeric M.m.p part of the version.
+//     Missing components are zero, so "6.1" is "6.1.0".
+//   - a wildcard, "6.6.*", matching any version with the leading components
+//   - a full version, "6.1.0-v8+", matching the version including its
+//     suffix, such as the local-version of a kernel release
+//   - a range of space separated comparisons that must all hold, with the
+//     operators >=, >, <=, < and =: ">=6.1.0 <6.2"
+type VersionConstraint []versionAlternative
+
+// versionAlternative holds all of its comparisons, or matches full
+type versionAlternative struct {
+	full        string
+	comparisons []versionComparison
+}
+
+type versionComparison struct {
+	op       string
+	version  []int
+	wildcard bool
+}
+
+// versionOperators are checked in order, so that ">=" is not read as ">"
+var versionOperators = []string{">=", "<=", ">", "<", "="}
+
+// ParseVersionConstraint parses a version constraint label
+func ParseVersionConstraint(label string) (VersionConstraint, error) {
+	var constraint VersionConstraint
+	for _, item := range strings.Split(label, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("empty alternative in %q", label)
+		}
+		var alternative versionAlternative
+		for _, field := range fields {
+			op := ""
+			for _, candidate := range versionOperators {
+				if rest, ok := strings.CutPrefix(field, candidate); ok {
+					op, field = candidate, rest
+					break
+				}
+			}
+			version, wildcard, suffix, err := parseVersion(field)
+			if err != nil {
+				return nil, err
+			}
+			if suffix != "" || wildcard {
+				// Full versions and wildcards stand alone
+				if len(fields) > 1 || (op != "" && op != "=") {
+					return nil, fmt.Errorf("%q cannot be combined with other comparisons", item)
+				}
+			}
+			if suffix != "" {
+				alternative.full = field
+				continue
+			}
+			if op == "" {
+				op = "="
+			}
+			alternative.comparisons = append(alternative.comparisons, versionComparison{op: op, version: version, wildcard: wildcard})
+		}
+		constraint = append(constraint, alternative)
+	}
+	return constraint, nil
+}
+
+// parseVersion parses "M.m.p", "M.m.*" or a full version such as
+// "6.1.0-v8+", returning the numeric components, whether the last one is a
+// wildcard, and the suffix of a full version
+func parseVersion(s string) ([]int, bool, string, error) {
+	end := strings.IndexAny(s, "-+")
+	if end < 0 {
+		end = len(s)
+	}
+	suffix := s[end:]
+	if end == 0 {
+		return nil, false, "", fmt.Errorf("invalid version %q", s)
+	}
+	components := strings.Split(s[:end], ".")
+	wildcard := components[len(components)-1] == "*"
+	if wildcard {
+		if suffix != "" || len(components) == 1 {
+			return nil, false, "", fmt.Errorf("invalid version wildcard %q", s)
+		}
+		components = components[:len(components)-1]
+	}
+	if len(components) > 3 {
+		return nil, false, "", fmt.Errorf("invalid version %q: more than 3 components", s)
+	}
+	version := make([]int, len(components))
+	for i, component := range components {
+		n, err := strconv.Atoi(component)
+		if err != nil || n < 0 {
+			return nil, false, "", fmt.Errorf("invalid version %q", s)
+		}
+		version[i] = n
+	}
+	return version, wildcard, suffix, nil
+}
+
+// compareVersions compares versions component-wise, treating missing
+// components as zero
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Matches tells whether full, a version such as a kernel release, satisfies
+// the constraint
+func (constraint VersionConstraint) Matches(full string) bool {
+	version, _, _, err := parseVersion(kernelVersionFromRelease(full))
+	for _, alternative := range constraint {
+		if alternative.full != "" {
+			if alternative.full == full {
+				return true
+			}
+			continue
+		}
+		if err == nil && alternative.matches(version) {
+			return true
+		}
+	}
+	return false
+}
+
+func (alternative versionAlternative) matches(version []int) bool {
+	for _, comparison := range alternative.comparisons {
+		if comparison.wildcard {
+			if len(version) < len(comparison.version) || compareVersions(version[:len(comparison.version)], comparison.version) != 0 {
+				return false
+			}
+			continue
+		}
+		cmp := compareVersions(version, comparison.version)
+		var ok bool
+		switch comparison.op {
+		case ">=":
+			ok = cmp >= 0
+		case ">":
+			ok = cmp > 0
+		case "<=":
+			ok = cmp <= 0
+		case "<":
+			ok = cmp < 0
+		default:
+			ok = cmp == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package hostapp
+
+import (
+	"testing"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		label   string
+		release string
+		matches bool
+	}{
+		{"6.1.0", "6.1.0-v8+", true},
+		{"6.1.0", "6.1.77-v8+", false},
+		{"6.1", "6.1.0", true},
+		{"5.15.0, 6.1.77", "6.1.77-100-generic", true},
+		{"5.15.0,6.1.76", "6.1.77-100-generic", false},
+		{">=6.1.0 <6.2", "6.1.77", true},
+		{">=6.1.0 <6.2", "6.2.0", false},
+		{">=6.1.0 <6.2", "6.0.9", false},
+		{">6.1 <=6.6.10", "6.6.10", true},
+		{"=6.6.10", "6.6.10", true},
+		{"6.6.*", "6.6.30-v7", true},
+		{"6.6.*", "6.7.0", false},
+		{"6.*", "6.12.3", true},
+		{"6.1.0-v8+", "6.1.0-v8+", true},
+		{"6.1.0-v8+", "6.1.0-v7+", false},
+		{"6.1.0-v7+, >=6.6", "6.1.0-v7+", true},
+		{"5.10.104", "5.10.104+", true},
+	}
+	for _, tt := range tests {
+		constraint, err := ParseVersionConstraint(tt.label)
+		if err != nil {
+			t.Errorf("ParseVersionConstraint(%q): %v", tt.label, err)
+			continue
+		}
+		if got := constraint.Matches(tt.release); got != tt.matches {
+			t.Errorf("%q matching %q: expected %v, got %v", tt.label, tt.release, tt.matches, got)
+		}
+	}
+}
+
+func TestVersionConstraintMalformed(t *testing.T) {
+	for _, label := range []string{
+		"",
+		"6.1.0,",
+		"six",
+		"6.1.x",
+		"6..1",
+		"6.1.0.1",
+		"*",
+		"6.*.1",
+		">=6.1.*",
+		"6.6.* <6.7",
+		"<6.1.0-v8+",
+		"6.1.0-v8+ >=6.1",
+		"=>6.1",
+		"-v8+",
+	} {
+		if _, err := ParseVersionConstraint(label); err == nil {
+			t.Errorf("expected an error parsing %q", label)
+		}
+	}
+}
+
+func TestFilterByKernelVersionConstraints(t *testing.T) {
+	reasons := map[string]string{}
+	Dropped = func(c Container, reason string) { reasons[c.Name] = reason }
+	defer func() { Dropped = nil }()
+
+	result := FilterByKernelVersion([]Container{
+		makeTestContainer("range", map[string]string{HOSTOS_BLOCKS_KERNEL_VERSION: ">=6.1 <6.2"}),
+		makeTestContainer("wildcard", map[string]string{HOSTOS_BLOCKS_KERNEL_VERSION: "6.6.*"}),
+		makeTestContainer("malformed", map[string]string{HOSTOS_BLOCKS_KERNEL_VERSION: "6.1.x"}),
+	}, "6.1.77-v8+")
+	if len(result) != 1 || result[0].Name != "range" {
+		t.Errorf("expected only range to pass, got %v", result)
+	}
+	if reasons["wildcard"] != `kernel version "6.6.*" != running "6.1.77-v8+"` {
+		t.Errorf("unexpected drop reason %q", reasons["wildcard"])
+	}
+	if reasons["malformed"] != `io.balena.image.kernel-version label: invalid version "6.1.x"` {
+		t.Errorf("unexpected drop reason %q", reasons["malformed"])
+	}
+}